@@ -0,0 +1,75 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"github.com/appsody/watcher"
+)
+
+// Build states reported by the control API
+const (
+	buildRunning   = "running"
+	buildSucceeded = "succeeded"
+	buildFailed    = "failed"
+)
+
+// the state of the last APPSODY_RUN/DEBUG/TEST_BUILD command, protected by cmps.mu
+var buildState string
+
+// runBuild runs the build command for the changed files before the ON_CHANGE action.
+// It is called with cmps.mu locked and returns with it locked, the lock is released while the build runs.
+// It returns false if the ON_CHANGE action should not go ahead, because the build failed or a newer build replaced it.
+func runBuild(changedFiles []watcher.Event, interactive bool, generation int) bool {
+	// a build for older changes is out of date
+	stopDetached(detachProcess(build))
+	if onChangeReplaced(generation) {
+		return false
+	}
+	env := changedFilesEnv(changedFiles)
+	cmd, err := startProcess(buildCommand, build, interactive, env)
+	if err != nil {
+		ControllerWarning.log("Received an error starting the APPSODY_RUN/DEBUG/TEST_BUILD command: ", buildCommand, " error received was: ", err)
+		removeChangedFilesManifest(env)
+		return false
+	}
+	buildState = buildRunning
+	cmps.mu.Unlock()
+
+	err = waitProcess(cmd, build)
+	removeChangedFilesManifest(env)
+
+	cmps.mu.Lock()
+	if cmps.pids[build] != cmd.Process.Pid {
+		// detachProcess clears the pid when a newer build replaces this one or the controller shuts down
+		ControllerDebug.logProcess(build, cmd.Process.Pid, "The APPSODY_RUN/DEBUG/TEST_BUILD process with pid ", cmd.Process.Pid, " was stopped before it finished.")
+		return false
+	}
+	cmps.pids[build] = 0
+	cmps.processes[build] = nil
+	// processes the build leaves running, such as a build daemon, are kept
+	releaseProcessTree(cmd.Process.Pid)
+	if err != nil {
+		buildState = buildFailed
+		exitCode := exitCodeFromError(err)
+		ControllerError.logProcess(build, cmd.Process.Pid, "The APPSODY_RUN/DEBUG/TEST_BUILD command failed with exit code ", exitCode,
+			", the ON_CHANGE action is skipped and the APPSODY_RUN/DEBUG/TEST process keeps running the last good build.")
+		publishEvent(controllerEvent{Type: eventBuildFailed, ProcessType: eventProcessTypes[build], Pid: cmd.Process.Pid, ExitCode: &exitCode})
+		cancelPendingChange()
+		return false
+	}
+	buildState = buildSucceeded
+	ControllerInfo.logProcess(build, cmd.Process.Pid, "The APPSODY_RUN/DEBUG/TEST_BUILD command succeeded, running the ON_CHANGE action.")
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/appsody/watcher"
+)
+
+// the environment variable which holds the location of the manifest of changed files
+const changedFilesManifestVar = "APPSODY_CHANGED_FILES_MANIFEST"
+
+type changedFile struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"`
+}
+
+// mergeChangedFiles reports each path once, keeping the first operation for the path unless the path was later removed
+func mergeChangedFiles(events []watcher.Event) []changedFile {
+	var changes []changedFile
+	index := make(map[string]int)
+	for _, event := range events {
+		change := changedFile{Op: event.Op.String(), Path: event.Path}
+		if event.Op == watcher.Rename || event.Op == watcher.Move {
+			change.OldPath = event.OldPath
+		}
+		if i, found := index[event.Path]; found {
+			if event.Op == watcher.Remove {
+				changes[i] = change
+			}
+			continue
+		}
+		index[event.Path] = len(changes)
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// the directory of this controller which holds the manifests of changed files, protected by changesDirMu
+var (
+	changesDir   string
+	changesDirMu sync.Mutex
+)
+
+// changedFilesDir returns the directory which holds the manifests of changed files for this controller.
+// It is created by ioutil.TempDir on first use, which only this user can access,
+// so that another local user can neither predict nor replace a manifest.
+func changedFilesDir() (string, error) {
+	changesDirMu.Lock()
+	defer changesDirMu.Unlock()
+	if changesDir == "" {
+		dir, err := ioutil.TempDir("", "appsody-controller-")
+		if err != nil {
+			return "", err
+		}
+		changesDir = dir
+	}
+	return changesDir, nil
+}
+
+// removeChangedFilesDir removes the directory of the manifests of changed files, if it was created
+func removeChangedFilesDir() {
+	changesDirMu.Lock()
+	defer changesDirMu.Unlock()
+	if changesDir != "" {
+		_ = os.RemoveAll(changesDir)
+		changesDir = ""
+	}
+}
+
+// changedFilesEnv writes a manifest of changed files for one command or hook and returns the environment variables
+// which describe the changes to it: APPSODY_CHANGED_FILES holds the ; separated paths and
+// APPSODY_CHANGED_FILES_MANIFEST the location of a JSON array of the paths and operations.
+// Each command gets its own manifest, so a later change can not replace the manifest it is reading,
+// removeChangedFilesManifest removes it once the command has exited.
+func changedFilesEnv(events []watcher.Event) []string {
+	if len(events) == 0 {
+		return nil
+	}
+	changes := mergeChangedFiles(events)
+	paths := make([]string, len(changes))
+	for i, change := range changes {
+		paths[i] = change.Path
+	}
+	env := []string{"APPSODY_CHANGED_FILES=" + strings.Join(paths, ";")}
+
+	manifest, err := writeChangedFilesManifest(changes)
+	if err != nil {
+		ControllerWarning.log("Could not write the changed files manifest ", err)
+		return env
+	}
+	return append(env, changedFilesManifestVar+"="+manifest)
+}
+
+// writeChangedFilesManifest writes the changes to a new manifest and returns its location
+func writeChangedFilesManifest(changes []changedFile) (string, error) {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return "", err
+	}
+	dir, err := changedFilesDir()
+	if err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, "changed-files-*.json")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// removeChangedFilesManifest removes the manifest in the environment variables returned by changedFilesEnv,
+// once the command or hook they were passed to has exited
+func removeChangedFilesManifest(env []string) {
+	for _, v := range env {
+		if strings.HasPrefix(v, changedFilesManifestVar+"=") {
+			_ = os.Remove(strings.TrimPrefix(v, changedFilesManifestVar+"="))
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// configCheck is the effective configuration printed by --check
+type configCheck struct {
+	Valid              bool     `json:"valid"`
+	Problems           []string `json:"problems"`
+	ConfigFile         string   `json:"configFile"`
+	Mode               string   `json:"mode"`
+	PrepCommand        string   `json:"prepCommand"`
+	PrepSteps          []string `json:"prepSteps"`
+	PrepTimeout        string   `json:"prepTimeout"`
+	PrepRetries        int      `json:"prepRetries"`
+	PrepWatchRegex     string   `json:"prepWatchRegex"`
+	PrepCacheInputs    []string `json:"prepCacheInputs"`
+	PrepCacheDir       string   `json:"prepCacheDir"`
+	StartCommand       string   `json:"startCommand"`
+	OnChangeCommand    string   `json:"onChangeCommand"`
+	BuildCommand       string   `json:"buildCommand"`
+	KillServerOnChange bool     `json:"killServerOnChange"`
+	ReloadSignal       string   `json:"reloadSignal"`
+	FileWatching       bool     `json:"fileWatching"`
+	WatchDirs          []string `json:"watchDirs"`
+	WatchDirsSource    string   `json:"watchDirsSource"`
+	WatchRegex         string   `json:"watchRegex"`
+	IgnoreDirs         []string `json:"ignoreDirs"`
+	WatchInterval      string   `json:"watchInterval"`
+	WatchBackend       string   `json:"watchBackend"`
+	WatchDebounce      string   `json:"watchDebounce"`
+	OnChangePolicy     string   `json:"onChangePolicy"`
+	OnChangeMaxQueue   int      `json:"onChangeMaxQueue"`
+	RestartPolicy      string   `json:"restartPolicy"`
+	ExitOnServerExit   bool     `json:"exitOnServerExit"`
+	PostStartHook      string   `json:"postStartHook"`
+	PreStopHook        string   `json:"preStopHook"`
+	OnFailureHook      string   `json:"onFailureHook"`
+	PostChangeHook     string   `json:"postChangeHook"`
+	HookTimeout        string   `json:"hookTimeout"`
+	StopSignal         string   `json:"stopSignal"`
+	StopTimeout        string   `json:"stopTimeout"`
+	OutputPrefix       bool     `json:"outputPrefix"`
+	OutputTimestamp    bool     `json:"outputTimestamp"`
+	OutputColor        string   `json:"outputColor"`
+	MetricsAddress     string   `json:"metricsAddress"`
+	ProcessTracking    string   `json:"processTracking"`
+	ForwardSignals     string   `json:"forwardSignals"`
+}
+
+// printConfigCheck prints the effective configuration for the controller mode as text or JSON,
+// it returns the exit code for the controller
+func printConfigCheck(format string, dirs []string, problems error) int {
+	check := configCheck{
+		Valid:              problems == nil,
+		Problems:           []string{},
+		ConfigFile:         configFile,
+		Mode:               controllerMode,
+		PrepCommand:        appsodyPREP,
+		PrepTimeout:        appsodyPREPTIMEOUT.String(),
+		PrepRetries:        appsodyPREPRETRIES,
+		PrepWatchRegex:     appsodyPREPWATCHREGEX,
+		PrepCacheInputs:    appsodyPREPCACHEINPUTS,
+		PrepCacheDir:       appsodyPREPCACHEDIR,
+		StartCommand:       startCommand,
+		OnChangeCommand:    fileChangeCommand,
+		BuildCommand:       buildCommand,
+		KillServerOnChange: stopWatchServerOnChange,
+		ReloadSignal:       reloadSignalName(reloadSignal),
+		FileWatching:       fileWatchingConfigured() && !disableWatcher,
+		WatchDirs:          dirs,
+		WatchDirsSource:    watchDirsSource,
+		WatchRegex:         appsodyWATCHREGEX,
+		IgnoreDirs:         appsodyWATCHIGNOREDIR,
+		WatchInterval:      appsodyWATCHINTERVAL.String(),
+		WatchBackend:       appsodyWATCHBACKEND,
+		WatchDebounce:      appsodyWATCHDEBOUNCE.String(),
+		OnChangePolicy:     appsodyONCHANGEPOLICY,
+		OnChangeMaxQueue:   appsodyONCHANGEMAXQUEUE,
+		RestartPolicy:      restartPolicy,
+		ExitOnServerExit:   exitOnServerExit,
+		PostStartHook:      hooks.commands[hookPostStart],
+		PreStopHook:        hooks.commands[hookPreStop],
+		OnFailureHook:      hooks.commands[hookOnFailure],
+		PostChangeHook:     hooks.commands[hookPostChange],
+		HookTimeout:        hooks.timeout.String(),
+		StopSignal:         signalName(stopSignal),
+		StopTimeout:        stopTimeout.String(),
+		OutputPrefix:       appsodyOUTPUTPREFIX,
+		OutputTimestamp:    appsodyOUTPUTTIMESTAMP,
+		OutputColor:        appsodyOUTPUTCOLOR,
+		MetricsAddress:     appsodyMETRICSADDRESS,
+		ProcessTracking:    appsodyPROCESSTRACKING,
+		ForwardSignals:     signalNames(appsodyFORWARDSIGNALS),
+	}
+	if errs, ok := problems.(configErrors); ok {
+		for _, err := range errs {
+			check.Problems = append(check.Problems, err.Error())
+		}
+	} else if problems != nil {
+		check.Problems = append(check.Problems, problems.Error())
+	}
+	if check.WatchDirs == nil {
+		check.WatchDirs = []string{}
+	}
+	if check.IgnoreDirs == nil {
+		check.IgnoreDirs = []string{}
+	}
+	for _, step := range appsodyPREPSTEPS {
+		check.PrepSteps = append(check.PrepSteps, step.String())
+	}
+	if check.PrepSteps == nil {
+		check.PrepSteps = []string{}
+	}
+	if check.PrepCacheInputs == nil {
+		check.PrepCacheInputs = []string{}
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(check); err != nil {
+			ControllerError.log("Could not write the configuration ", err)
+			return 1
+		}
+	case "text":
+		printConfigCheckText(check)
+	default:
+		ControllerError.log("Invalid --format, use text or json: ", format)
+		return 1
+	}
+	if !check.Valid {
+		return exitCodeInvalidConfig
+	}
+	return 0
+}
+
+func printConfigCheckText(check configCheck) {
+	mode := strings.ToUpper(check.Mode)
+	configFile := check.ConfigFile
+	if configFile == "" {
+		configFile = "(none)"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Mode:\t%v\n", check.Mode)
+	fmt.Fprintf(w, "Configuration file:\t%v\n", configFile)
+	fmt.Fprintf(w, "Prep command (APPSODY_PREP):\t%v\n", check.PrepCommand)
+	fmt.Fprintf(w, "Prep steps:\t%v\n", strings.Join(check.PrepSteps, "; "))
+	fmt.Fprintf(w, "Prep step timeout (APPSODY_PREP_TIMEOUT):\t%v\n", check.PrepTimeout)
+	fmt.Fprintf(w, "Prep step retries (APPSODY_PREP_RETRIES):\t%v\n", check.PrepRetries)
+	fmt.Fprintf(w, "Prep watched files (APPSODY_PREP_WATCH_REGEX):\t%v\n", check.PrepWatchRegex)
+	fmt.Fprintf(w, "Prep cache inputs (APPSODY_PREP_CACHE_INPUTS):\t%v\n", strings.Join(check.PrepCacheInputs, ", "))
+	fmt.Fprintf(w, "Prep cache directory (APPSODY_PREP_CACHE_DIR):\t%v\n", check.PrepCacheDir)
+	fmt.Fprintf(w, "Start command (APPSODY_%v):\t%v\n", mode, check.StartCommand)
+	fmt.Fprintf(w, "ON_CHANGE command (APPSODY_%v_ON_CHANGE):\t%v\n", mode, check.OnChangeCommand)
+	fmt.Fprintf(w, "Build command (APPSODY_%v_BUILD):\t%v\n", mode, check.BuildCommand)
+	fmt.Fprintf(w, "Kill the server on change (APPSODY_%v_KILL):\t%v\n", mode, check.KillServerOnChange)
+	fmt.Fprintf(w, "Reload signal (APPSODY_%v_RELOAD_SIGNAL):\t%v\n", mode, check.ReloadSignal)
+	fmt.Fprintf(w, "File watching:\t%v\n", check.FileWatching)
+	fmt.Fprintf(w, "Watched directories (from %v):\t%v\n", check.WatchDirsSource, strings.Join(check.WatchDirs, ", "))
+	fmt.Fprintf(w, "Watched files (APPSODY_WATCH_REGEX):\t%v\n", check.WatchRegex)
+	fmt.Fprintf(w, "Ignored directories (APPSODY_WATCH_IGNORE_DIR):\t%v\n", strings.Join(check.IgnoreDirs, ", "))
+	fmt.Fprintf(w, "Watch interval (APPSODY_WATCH_INTERVAL):\t%v\n", check.WatchInterval)
+	fmt.Fprintf(w, "Watch backend (APPSODY_WATCH_BACKEND):\t%v\n", check.WatchBackend)
+	fmt.Fprintf(w, "Watch debounce (APPSODY_WATCH_DEBOUNCE):\t%v\n", check.WatchDebounce)
+	fmt.Fprintf(w, "ON_CHANGE policy (APPSODY_ON_CHANGE_POLICY):\t%v\n", check.OnChangePolicy)
+	fmt.Fprintf(w, "ON_CHANGE queue depth (APPSODY_ON_CHANGE_MAX_QUEUE):\t%v\n", check.OnChangeMaxQueue)
+	fmt.Fprintf(w, "Restart policy (APPSODY_%v_RESTART):\t%v\n", mode, check.RestartPolicy)
+	fmt.Fprintf(w, "Exit when the server exits (APPSODY_%v_EXIT_ON_SERVER_EXIT):\t%v\n", mode, check.ExitOnServerExit)
+	fmt.Fprintf(w, "Post-start hook (APPSODY_%v_POST_START):\t%v\n", mode, check.PostStartHook)
+	fmt.Fprintf(w, "Pre-stop hook (APPSODY_%v_PRE_STOP):\t%v\n", mode, check.PreStopHook)
+	fmt.Fprintf(w, "On-failure hook (APPSODY_%v_ON_FAILURE):\t%v\n", mode, check.OnFailureHook)
+	fmt.Fprintf(w, "Post-change hook (APPSODY_%v_POST_CHANGE):\t%v\n", mode, check.PostChangeHook)
+	fmt.Fprintf(w, "Hook timeout (APPSODY_%v_HOOK_TIMEOUT):\t%v\n", mode, check.HookTimeout)
+	fmt.Fprintf(w, "Stop signal (APPSODY_%v_STOP_SIGNAL):\t%v\n", mode, check.StopSignal)
+	fmt.Fprintf(w, "Stop timeout (APPSODY_%v_STOP_TIMEOUT):\t%v\n", mode, check.StopTimeout)
+	fmt.Fprintf(w, "Output prefix (APPSODY_OUTPUT_PREFIX):\t%v\n", check.OutputPrefix)
+	fmt.Fprintf(w, "Output timestamp (APPSODY_OUTPUT_TIMESTAMP):\t%v\n", check.OutputTimestamp)
+	fmt.Fprintf(w, "Output color (APPSODY_OUTPUT_COLOR):\t%v\n", check.OutputColor)
+	fmt.Fprintf(w, "Metrics address (APPSODY_METRICS_ADDRESS):\t%v\n", check.MetricsAddress)
+	fmt.Fprintf(w, "Process tracking (APPSODY_PROCESS_TRACKING):\t%v\n", check.ProcessTracking)
+	fmt.Fprintf(w, "Forwarded signals (APPSODY_FORWARD_SIGNALS):\t%v\n", check.ForwardSignals)
+	_ = w.Flush()
+
+	if check.Valid {
+		fmt.Println("The configuration is valid.")
+		return
+	}
+	fmt.Printf("The configuration is invalid, %v problem(s) found:\n", len(check.Problems))
+	for _, problem := range check.Problems {
+		fmt.Println("  - " + problem)
+	}
+}
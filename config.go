@@ -0,0 +1,385 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the configuration files looked for in the project directory when --config is not given
+var defaultConfigFiles = []string{".appsody-controller.yaml", ".appsody-controller.yml", ".appsody-controller.json"}
+
+// the configuration file in use, empty if there is none
+var configFile string
+
+// duration is a time.Duration read from a string such as 500ms or 2s
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) parse(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("a duration must be a string such as \"2s\" or \"500ms\": %v", string(data))
+	}
+	return d.parse(value)
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.parse(value)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+type watchConfig struct {
+	Dirs       []string  `json:"dirs" yaml:"dirs"`
+	IgnoreDirs []string  `json:"ignoreDirs" yaml:"ignoreDirs"`
+	Regex      string    `json:"regex" yaml:"regex"`
+	Interval   *duration `json:"interval" yaml:"interval"`
+	Backend    string    `json:"backend" yaml:"backend"`
+	Debounce   *duration `json:"debounce" yaml:"debounce"`
+}
+
+// prepFileConfig is the prep setting, either a command or a list of steps
+type prepFileConfig struct {
+	Command string
+	Steps   []prepStepConfig
+}
+
+func (p *prepFileConfig) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Command); err == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p.Steps); err != nil {
+		return fmt.Errorf("prep must be a command or a list of steps with a name, command, timeout and retries: %v", err)
+	}
+	return nil
+}
+
+func (p *prepFileConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&p.Command); err == nil {
+		return nil
+	}
+	return unmarshal(&p.Steps)
+}
+
+type prepCacheConfig struct {
+	Inputs []string `json:"inputs" yaml:"inputs"`
+	Dir    string   `json:"dir" yaml:"dir"`
+}
+
+type restartConfig struct {
+	MaxRetries *int      `json:"maxRetries" yaml:"maxRetries"`
+	Backoff    *duration `json:"backoff" yaml:"backoff"`
+}
+
+type probeFileConfig struct {
+	Probe            string    `json:"probe" yaml:"probe"`
+	Interval         *duration `json:"interval" yaml:"interval"`
+	Timeout          *duration `json:"timeout" yaml:"timeout"`
+	SuccessThreshold *int      `json:"successThreshold" yaml:"successThreshold"`
+	FailureThreshold *int      `json:"failureThreshold" yaml:"failureThreshold"`
+}
+
+type outputConfig struct {
+	Prefix    *bool  `json:"prefix" yaml:"prefix"`
+	Timestamp *bool  `json:"timestamp" yaml:"timestamp"`
+	Color     string `json:"color" yaml:"color"`
+}
+
+// hooksConfig holds the lifecycle hook commands of a mode
+type hooksConfig struct {
+	PostStart  string    `json:"postStart" yaml:"postStart"`
+	PreStop    string    `json:"preStop" yaml:"preStop"`
+	OnFailure  string    `json:"onFailure" yaml:"onFailure"`
+	PostChange string    `json:"postChange" yaml:"postChange"`
+	Timeout    *duration `json:"timeout" yaml:"timeout"`
+}
+
+// modeConfig holds the settings for one of the run, debug and test modes
+type modeConfig struct {
+	Command          string      `json:"command" yaml:"command"`
+	OnChange         string      `json:"onChange" yaml:"onChange"`
+	Kill             *bool       `json:"kill" yaml:"kill"`
+	Build            string      `json:"build" yaml:"build"`
+	Restart          string      `json:"restart" yaml:"restart"`
+	StopSignal       string      `json:"stopSignal" yaml:"stopSignal"`
+	StopTimeout      *duration   `json:"stopTimeout" yaml:"stopTimeout"`
+	ReloadSignal     string      `json:"reloadSignal" yaml:"reloadSignal"`
+	ExitOnServerExit *bool       `json:"exitOnServerExit" yaml:"exitOnServerExit"`
+	Hooks            hooksConfig `json:"hooks" yaml:"hooks"`
+}
+
+// controllerConfig is the layout of the configuration file, each setting corresponds to an APPSODY_* environment variable
+type controllerConfig struct {
+	Prep             prepFileConfig   `json:"prep" yaml:"prep"`
+	PrepTimeout      *duration        `json:"prepTimeout" yaml:"prepTimeout"`
+	PrepRetries      *int             `json:"prepRetries" yaml:"prepRetries"`
+	PrepWatchRegex   string           `json:"prepWatchRegex" yaml:"prepWatchRegex"`
+	PrepCache        prepCacheConfig  `json:"prepCache" yaml:"prepCache"`
+	Mounts           []string         `json:"mounts" yaml:"mounts"`
+	Watch            watchConfig      `json:"watch" yaml:"watch"`
+	OnChangePolicy   string           `json:"onChangePolicy" yaml:"onChangePolicy"`
+	OnChangeMaxQueue *int             `json:"onChangeMaxQueue" yaml:"onChangeMaxQueue"`
+	Restart          restartConfig    `json:"restart" yaml:"restart"`
+	ReadinessProbe   *probeFileConfig `json:"readinessProbe" yaml:"readinessProbe"`
+	LivenessProbe    *probeFileConfig `json:"livenessProbe" yaml:"livenessProbe"`
+	ControlSocket    string           `json:"controlSocket" yaml:"controlSocket"`
+	MetricsAddress   string           `json:"metricsAddress" yaml:"metricsAddress"`
+	ProcessTracking  string           `json:"processTracking" yaml:"processTracking"`
+	ForwardSignals   []string         `json:"forwardSignals" yaml:"forwardSignals"`
+	Output           outputConfig     `json:"output" yaml:"output"`
+	Run              modeConfig       `json:"run" yaml:"run"`
+	Debug            modeConfig       `json:"debug" yaml:"debug"`
+	Test             modeConfig       `json:"test" yaml:"test"`
+}
+
+// parseConfig reads a JSON configuration file if the file name ends with .json and a YAML file otherwise,
+// settings the controller does not know about are reported as errors
+func parseConfig(path string, data []byte) (*controllerConfig, error) {
+	config := &controllerConfig{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configEnvironment collects the environment variable values for the configuration file settings
+type configEnvironment struct {
+	values map[string]string
+	err    error
+}
+
+func (e *configEnvironment) set(name string, value string) {
+	if value != "" {
+		e.values[name] = value
+	}
+}
+
+func (e *configEnvironment) setList(name string, values []string) {
+	e.set(name, strings.Join(values, ";"))
+}
+
+func (e *configEnvironment) setInt(name string, value *int) {
+	if value != nil {
+		e.set(name, strconv.Itoa(*value))
+	}
+}
+
+func (e *configEnvironment) setBool(name string, value *bool) {
+	if value != nil {
+		e.set(name, strconv.FormatBool(*value))
+	}
+}
+
+// setDuration converts the duration to the whole number of seconds or milliseconds used by the environment variable
+func (e *configEnvironment) setDuration(name string, value *duration, unit time.Duration) {
+	if value == nil {
+		return
+	}
+	if value.Duration%unit != 0 || value.Duration < 0 {
+		if e.err == nil {
+			e.err = fmt.Errorf("the setting for %v must be a whole number of %v, not %v", name, unitName(unit), value.Duration)
+		}
+		return
+	}
+	e.set(name, strconv.FormatInt(int64(value.Duration/unit), 10))
+}
+
+func unitName(unit time.Duration) string {
+	if unit == time.Millisecond {
+		return "milliseconds"
+	}
+	return "seconds"
+}
+
+func (e *configEnvironment) setProbe(name string, probe *probeFileConfig) {
+	if probe == nil {
+		return
+	}
+	e.set(name, probe.Probe)
+	e.setDuration(name+"_INTERVAL", probe.Interval, time.Second)
+	e.setDuration(name+"_TIMEOUT", probe.Timeout, time.Second)
+	e.setInt(name+"_SUCCESS_THRESHOLD", probe.SuccessThreshold)
+	e.setInt(name+"_FAILURE_THRESHOLD", probe.FailureThreshold)
+}
+
+// setPrep sets the prep command, or the list of steps as the JSON accepted by APPSODY_PREP
+func (e *configEnvironment) setPrep(name string, prep prepFileConfig) {
+	if prep.Steps == nil {
+		e.set(name, prep.Command)
+		return
+	}
+	steps, err := json.Marshal(prep.Steps)
+	if err != nil {
+		if e.err == nil {
+			e.err = fmt.Errorf("the setting for %v can not be converted to JSON: %v", name, err)
+		}
+		return
+	}
+	e.set(name, string(steps))
+}
+
+func (e *configEnvironment) setMode(mode string, config modeConfig) {
+	e.set("APPSODY_"+mode, config.Command)
+	e.set("APPSODY_"+mode+"_ON_CHANGE", config.OnChange)
+	e.setBool("APPSODY_"+mode+"_KILL", config.Kill)
+	e.set("APPSODY_"+mode+"_BUILD", config.Build)
+	e.set("APPSODY_"+mode+"_RESTART", config.Restart)
+	e.set("APPSODY_"+mode+"_STOP_SIGNAL", config.StopSignal)
+	e.setDuration("APPSODY_"+mode+"_STOP_TIMEOUT", config.StopTimeout, time.Second)
+	e.set("APPSODY_"+mode+"_RELOAD_SIGNAL", config.ReloadSignal)
+	e.setBool("APPSODY_"+mode+"_EXIT_ON_SERVER_EXIT", config.ExitOnServerExit)
+	e.set("APPSODY_"+mode+"_"+hookPostStart, config.Hooks.PostStart)
+	e.set("APPSODY_"+mode+"_"+hookPreStop, config.Hooks.PreStop)
+	e.set("APPSODY_"+mode+"_"+hookOnFailure, config.Hooks.OnFailure)
+	e.set("APPSODY_"+mode+"_"+hookPostChange, config.Hooks.PostChange)
+	e.setDuration("APPSODY_"+mode+"_HOOK_TIMEOUT", config.Hooks.Timeout, time.Second)
+}
+
+// environment returns the APPSODY_* environment variables for the settings in the configuration file
+func (c *controllerConfig) environment() (map[string]string, error) {
+	env := &configEnvironment{values: make(map[string]string)}
+	env.setPrep("APPSODY_PREP", c.Prep)
+	env.setDuration("APPSODY_PREP_TIMEOUT", c.PrepTimeout, time.Second)
+	env.setInt("APPSODY_PREP_RETRIES", c.PrepRetries)
+	env.set("APPSODY_PREP_WATCH_REGEX", c.PrepWatchRegex)
+	env.setList("APPSODY_PREP_CACHE_INPUTS", c.PrepCache.Inputs)
+	env.set("APPSODY_PREP_CACHE_DIR", c.PrepCache.Dir)
+	env.setList("APPSODY_MOUNTS", c.Mounts)
+	env.setList("APPSODY_WATCH_DIR", c.Watch.Dirs)
+	env.setList("APPSODY_WATCH_IGNORE_DIR", c.Watch.IgnoreDirs)
+	env.set("APPSODY_WATCH_REGEX", c.Watch.Regex)
+	env.setDuration("APPSODY_WATCH_INTERVAL", c.Watch.Interval, time.Second)
+	env.set("APPSODY_WATCH_BACKEND", c.Watch.Backend)
+	env.setDuration("APPSODY_WATCH_DEBOUNCE", c.Watch.Debounce, time.Millisecond)
+	env.set("APPSODY_ON_CHANGE_POLICY", c.OnChangePolicy)
+	env.setInt("APPSODY_ON_CHANGE_MAX_QUEUE", c.OnChangeMaxQueue)
+	env.setInt("APPSODY_RESTART_MAX_RETRIES", c.Restart.MaxRetries)
+	env.setDuration("APPSODY_RESTART_BACKOFF", c.Restart.Backoff, time.Millisecond)
+	env.setProbe("APPSODY_READINESS_PROBE", c.ReadinessProbe)
+	env.setProbe("APPSODY_LIVENESS_PROBE", c.LivenessProbe)
+	env.set("APPSODY_CONTROL_SOCKET", c.ControlSocket)
+	env.set("APPSODY_METRICS_ADDRESS", c.MetricsAddress)
+	env.set("APPSODY_PROCESS_TRACKING", c.ProcessTracking)
+	if c.ForwardSignals != nil && len(c.ForwardSignals) == 0 {
+		// an empty list turns the forwarding off
+		env.set("APPSODY_FORWARD_SIGNALS", "none")
+	} else {
+		env.set("APPSODY_FORWARD_SIGNALS", strings.Join(c.ForwardSignals, ","))
+	}
+	env.setBool("APPSODY_OUTPUT_PREFIX", c.Output.Prefix)
+	env.setBool("APPSODY_OUTPUT_TIMESTAMP", c.Output.Timestamp)
+	env.set("APPSODY_OUTPUT_COLOR", c.Output.Color)
+	env.setMode("RUN", c.Run)
+	env.setMode("DEBUG", c.Debug)
+	env.setMode("TEST", c.Test)
+	return env.values, env.err
+}
+
+// findConfigFile returns the configuration file given by --config, or else the first default configuration
+// file in the project directory, or an empty string if there is none
+func findConfigFile(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	for _, name := range defaultConfigFiles {
+		path := filepath.Join(workDir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadConfigFile sets the environment variables for the settings in the configuration file.
+// Environment variables which are already set take precedence over the configuration file.
+func loadConfigFile(flagValue string) error {
+	path := findConfigFile(flagValue)
+	if path == "" {
+		ControllerDebug.log("No controller configuration file was found, using the environment variables only.")
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := parseConfig(path, data)
+	if err != nil {
+		return fmt.Errorf("could not parse the controller configuration file %v: %v", path, err)
+	}
+	env, err := config.environment()
+	if err != nil {
+		return fmt.Errorf("invalid controller configuration file %v: %v", path, err)
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var overridden []string
+	for _, name := range names {
+		if os.Getenv(name) != "" {
+			overridden = append(overridden, name)
+			continue
+		}
+		if err := os.Setenv(name, env[name]); err != nil {
+			return err
+		}
+	}
+	configFile = path
+	ControllerInfo.log("Using the controller configuration file ", path, ", APPSODY_* environment variables take precedence over the settings in the file.")
+	if len(overridden) > 0 {
+		ControllerInfo.log("The configuration file settings are overridden by the environment variables: ", strings.Join(overridden, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// the default location of the control socket, /.appsody is the volume shared with the Appsody CLI
+const defaultControlSocket = "/.appsody/appsody-controller.sock"
+
+var controlListener net.Listener
+
+type controllerStatus struct {
+	Version          string `json:"version"`
+	Mode             string `json:"mode"`
+	Uptime           string `json:"uptime"`
+	ServerPid        int    `json:"serverPid"`
+	OnChangePid      int    `json:"onChangePid"`
+	ServerExitCode   *int   `json:"serverExitCode"`
+	OnChangeExitCode *int   `json:"onChangeExitCode"`
+	// nil when no readiness probe is configured
+	ServerReady *bool `json:"serverReady"`
+	// the state of the last APPSODY_RUN/DEBUG/TEST_BUILD command, empty if no build has run
+	BuildState string `json:"buildState"`
+}
+
+type controlResponse struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startControlServer serves the control API as JSON over HTTP on a Unix domain socket.
+// The socket location is taken from APPSODY_CONTROL_SOCKET, if the directory for the socket
+// does not exist the control API is not started.
+func startControlServer() {
+	socketPath := os.Getenv("APPSODY_CONTROL_SOCKET")
+	if socketPath == "" {
+		socketPath = defaultControlSocket
+	}
+	if _, err := os.Stat(filepath.Dir(socketPath)); err != nil {
+		ControllerDebug.log("The control API is not started, the directory for the control socket does not exist: ", socketPath)
+		return
+	}
+	// remove a socket left behind by a previous controller
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		ControllerWarning.log("Could not remove the existing control socket ", socketPath, " ", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		ControllerWarning.log("Could not start the control API on socket ", socketPath, " ", err)
+		return
+	}
+	controlListener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/restart", handleRestart)
+	mux.HandleFunc("/onchange", handleOnChange)
+	mux.HandleFunc("/shutdown", handleShutdown)
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	ControllerDebug.log("The control API is listening on socket: ", socketPath)
+	go func() {
+		err := http.Serve(listener, mux)
+		ControllerDebug.log("The control API has stopped: ", err)
+	}()
+}
+
+// stopControlServer closes the control socket, which also removes the socket file
+func stopControlServer() {
+	if controlListener != nil {
+		_ = controlListener.Close()
+	}
+}
+
+func writeControlResponse(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		ControllerDebug.log("Could not write the control API response ", err)
+	}
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeControlResponse(w, http.StatusMethodNotAllowed, controlResponse{Error: "method " + r.Method + " is not allowed, use " + method})
+		return false
+	}
+	return true
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := controllerStatus{
+		Version: VERSION,
+		Mode:    controllerMode,
+		Uptime:  time.Since(controllerStartTime).Round(time.Second).String(),
+	}
+	cmps.mu.RLock()
+	status.ServerPid = cmps.pids[server]
+	status.OnChangePid = cmps.pids[fileWatcher]
+	status.BuildState = buildState
+	if exitCode, ok := cmps.exitCodes[server]; ok {
+		status.ServerExitCode = &exitCode
+	}
+	if exitCode, ok := cmps.exitCodes[fileWatcher]; ok {
+		status.OnChangeExitCode = &exitCode
+	}
+	cmps.mu.RUnlock()
+	status.ServerReady = serverReady()
+	writeControlResponse(w, http.StatusOK, status)
+}
+
+func handleRestart(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	ControllerInfo.log("Restart of the APPSODY_RUN/DEBUG/TEST process requested through the control API.")
+	go restartServer(restartReasonRequested)
+	writeControlResponse(w, http.StatusAccepted, controlResponse{Result: "restarting"})
+}
+
+func handleOnChange(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !onChangeConfigured() {
+		writeControlResponse(w, http.StatusConflict, controlResponse{Error: "no APPSODY_RUN/DEBUG/TEST_ON_CHANGE action or RELOAD_SIGNAL is configured for mode " + controllerMode})
+		return
+	}
+	ControllerInfo.log("ON_CHANGE action requested through the control API.")
+	go scheduleOnChange(fileChangeCommand, stopWatchServerOnChange, interactiveFlag, nil)
+	writeControlResponse(w, http.StatusAccepted, controlResponse{Result: "running ON_CHANGE action"})
+}
+
+func handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	ControllerInfo.log("Shutdown requested through the control API.")
+	writeControlResponse(w, http.StatusAccepted, controlResponse{Result: "shutting down"})
+	go shutdownController(0)
+}
+
+// restartServer kills the ON_CHANGE and server processes and starts the APPSODY_RUN/DEBUG/TEST command again.
+// If the server is running, the goroutine waiting on it restarts it, otherwise a new server is started here.
+// The reason, restartReasonRequested or restartReasonLiveness, is logged and counted by the restart metric.
+func restartServer(reason string) {
+	cmps.mu.Lock()
+	serverRunning := cmps.processes[server] != nil && cmps.processes[server].Signal(syscall.Signal(0)) == nil
+	if serverRunning {
+		cmps.restartRequested = reason
+	}
+	onChange := detachProcess(fileWatcher)
+	serving := detachProcess(server)
+	cmps.mu.Unlock()
+
+	// the server is stopped without cmps.mu locked, the goroutine waiting on it starts it once it has gone
+	err := onChange.stop()
+	if err != nil {
+		ControllerWarning.log("Killing the the APPSODY_RUN/DEBUG/TEST_ON_CHANGE process received error ", err)
+	}
+	err = serving.stop()
+	if err != nil {
+		ControllerWarning.log("The attempt to kill the process received an error ", err)
+	}
+
+	if !serverRunning {
+		go runCommands(startCommand, server, false, false, interactiveFlag, nil)
+	}
+}
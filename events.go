@@ -0,0 +1,158 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Controller lifecycle event types
+const (
+	eventWatch           = "watchEvent"
+	eventWatcherError    = "watcherError"
+	eventOnChangeStarted = "onChangeStarted"
+	eventProcessStarted  = "processStarted"
+	eventProcessKilled   = "processKilled"
+	eventProcessExited   = "processExited"
+	eventPrepFinished    = "prepFinished"
+	eventServerRestart   = "serverRestart"
+	eventCrashLoop       = "crashLoop"
+	eventServerReady     = "serverReady"
+	eventServerNotReady  = "serverNotReady"
+	eventLivenessFailed  = "livenessFailed"
+	eventBuildFailed     = "buildFailed"
+	eventLeftoversKilled = "leftoversKilled"
+	eventServerReloaded  = "serverReloaded"
+)
+
+// the size of the buffer for each subscriber, events are dropped for subscribers that fall behind
+const eventBufferSize = 100
+
+var eventProcessTypes = map[ProcessType]string{
+	server:      "server",
+	fileWatcher: "onChange",
+	build:       "build",
+	prep:        "prep",
+}
+
+type controllerEvent struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	ProcessType string    `json:"processType,omitempty"`
+	Pid         int       `json:"pid,omitempty"`
+	ExitCode    *int      `json:"exitCode,omitempty"`
+	Op          string    `json:"op,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Message     string    `json:"message,omitempty"`
+}
+
+type eventBroker struct {
+	subscribers map[chan controllerEvent]struct{}
+	mu          sync.Mutex
+}
+
+var controllerEvents = &eventBroker{
+	subscribers: make(map[chan controllerEvent]struct{}),
+}
+
+func (b *eventBroker) subscribe() chan controllerEvent {
+	ch := make(chan controllerEvent, eventBufferSize)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan controllerEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+func (b *eventBroker) publish(event controllerEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// never block the controller on a slow subscriber
+		}
+	}
+}
+
+// publishEvent sends a lifecycle event to every subscriber of the event stream
+func publishEvent(event controllerEvent) {
+	event.Time = time.Now()
+	controllerEvents.publish(event)
+}
+
+// publishProcessEvent sends a lifecycle event for one of the controller managed processes
+func publishProcessEvent(eventType string, theProcessType ProcessType, pid int) {
+	publishEvent(controllerEvent{Type: eventType, ProcessType: eventProcessTypes[theProcessType], Pid: pid})
+}
+
+// handleEvents streams the lifecycle events as Server-Sent Events, or as newline delimited JSON
+// when format=ndjson is requested
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeControlResponse(w, http.StatusInternalServerError, controlResponse{Error: "streaming is not supported"})
+		return
+	}
+	ndjson := r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	events := controllerEvents.subscribe()
+	defer controllerEvents.unsubscribe(events)
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				ControllerDebug.log("Could not marshal the controller event ", err)
+				continue
+			}
+			if ndjson {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			} else {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how long the shutdown waits for the exit status of the stopped server to be recorded
+const exitStatusTimeout = time.Second
+
+// processExit is the exit status of the last process of a process type
+type processExit struct {
+	pid    int
+	status int
+}
+
+var (
+	lastExits   = make(map[ProcessType]processExit)
+	lastExitsMu sync.Mutex
+)
+
+// exitStatus returns the exit status the controller uses for a process which ended with the error from cmd.Wait,
+// following the shell: the exit code, or 128 + the signal number for a process ended by a signal
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// recordExit records the exit status of a process which has been waited for
+func recordExit(theProcessType ProcessType, pid int, err error) {
+	lastExitsMu.Lock()
+	lastExits[theProcessType] = processExit{pid: pid, status: exitStatus(err)}
+	lastExitsMu.Unlock()
+}
+
+// waitForExitStatus returns the exit status of the process once it has been recorded,
+// false is returned if it is not recorded within the timeout
+func waitForExitStatus(theProcessType ProcessType, pid int, timeout time.Duration) (int, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lastExitsMu.Lock()
+		exit := lastExits[theProcessType]
+		lastExitsMu.Unlock()
+		if exit.pid == pid {
+			return exit.status, true
+		}
+		if !time.Now().Before(deadline) {
+			return 0, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// shutdownController stops the managed processes and exits with the exit status of the server.
+// If there is no server, the controller exits with 128 + the number of the signal which stopped it, or 0 without a signal.
+func shutdownController(sig syscall.Signal) {
+	theProcessType, pid := servingProcess()
+	stopControllerManagedProcesses()
+	exitCode := 0
+	if sig != 0 {
+		exitCode = 128 + int(sig)
+	}
+	if pid != 0 {
+		if status, ok := waitForExitStatus(theProcessType, pid, exitStatusTimeout); ok {
+			exitCode = status
+		}
+	}
+	ControllerDebug.log("The controller is exiting with exit code ", exitCode)
+	os.Exit(exitCode)
+}
+
+// exitWithServer ends the controller when the server has exited on its own and APPSODY_RUN/DEBUG/TEST_EXIT_ON_SERVER_EXIT is true
+func exitWithServer(theProcessType ProcessType, pid int, err error) {
+	exitCode := exitStatus(err)
+	ControllerInfo.logProcess(theProcessType, pid, "The ", processTypeToString(theProcessType), " process with pid ", pid, " exited with exit code ", exitCode,
+		", the controller is exiting because APPSODY_", strings.ToUpper(controllerMode), "_EXIT_ON_SERVER_EXIT is true.")
+	stopControllerManagedProcesses()
+	os.Exit(exitCode)
+}
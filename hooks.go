@@ -0,0 +1,173 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The lifecycle hooks, each is set with APPSODY_<MODE>_<hook>
+const (
+	hookPostStart  = "POST_START"
+	hookPreStop    = "PRE_STOP"
+	hookOnFailure  = "ON_FAILURE"
+	hookPostChange = "POST_CHANGE"
+)
+
+// the names of the hooks, in the order they are listed by --check
+var hookNames = []string{hookPostStart, hookPreStop, hookOnFailure, hookPostChange}
+
+// how long a hook may run when APPSODY_<MODE>_HOOK_TIMEOUT is not set
+const defaultHookTimeout = 30 * time.Second
+
+// the colour of the prefix of the hook output
+const hookColor = "\x1b[34m"
+
+// lifecycleHooks holds the hook commands of a mode, by hook name, and how long each of them may run
+type lifecycleHooks struct {
+	commands map[string]string
+	timeout  time.Duration
+}
+
+// the hooks of the controller mode
+var hooks lifecycleHooks
+
+// computeHooks reads the APPSODY_<MODE>_POST_START, _PRE_STOP, _ON_FAILURE, _POST_CHANGE and _HOOK_TIMEOUT settings of a mode
+func computeHooks(mode string) (lifecycleHooks, error) {
+	h := lifecycleHooks{commands: make(map[string]string)}
+	for _, name := range hookNames {
+		if command := os.Getenv("APPSODY_" + mode + "_" + name); strings.TrimSpace(command) != "" {
+			h.commands[name] = command
+		}
+	}
+	envVar := "APPSODY_" + mode + "_HOOK_TIMEOUT"
+	timeout, err := computeWholeNumber(envVar, os.Getenv(envVar), int(defaultHookTimeout/time.Second), 1, "seconds")
+	h.timeout = time.Duration(timeout) * time.Second
+	return h, err
+}
+
+// hookEnvVar returns the name of the environment variable of a hook in the controller mode
+func hookEnvVar(name string) string {
+	return "APPSODY_" + strings.ToUpper(controllerMode) + "_" + name
+}
+
+// runHook runs the hook command, if the hook is set, and waits for it to finish.
+// The hook is stopped if it runs for longer than the hook timeout. Its output is always prefixed with the hook name.
+// The env holds extra environment variables for the hook, such as APPSODY_SERVER_PID.
+func runHook(name string, env []string) error {
+	command := hooks.commands[name]
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(), "APPSODY_HOOK="+name)
+	cmd.Env = append(cmd.Env, env...)
+	cycle := atomic.LoadInt64(&restartCycle)
+	stdout := newPrefixWriter(os.Stdout, name+" hook", cycle)
+	stderr := newPrefixWriter(os.Stderr, name+" hook", cycle)
+	if colorOutput(os.Stdout) {
+		stdout.color = hookColor
+	}
+	if colorOutput(os.Stderr) {
+		stderr.color = hookColor
+	}
+	output := &processOutput{stdout: stdout, stderr: stderr}
+	output.pipe(&cmd.Stdout, stdout)
+	output.pipe(&cmd.Stderr, stderr)
+	// the hook and its descendants are stopped together on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	ControllerInfo.log("Running the ", hookEnvVar(name), " hook: ", command)
+	started := time.Now()
+	if err := startChild(cmd); err != nil {
+		output.finish()
+		ControllerWarning.log("Could not start the ", hookEnvVar(name), " hook: ", err)
+		return err
+	}
+	output.started()
+	pid := cmd.Process.Pid
+	var timedOut int32
+	timer := time.AfterFunc(hooks.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		ControllerWarning.log("The ", hookEnvVar(name), " hook did not finish within ", hooks.timeout, ", stopping it.")
+		if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			ControllerWarning.log("Killing the ", hookEnvVar(name), " hook received error ", err)
+		}
+	})
+	err := waitChild(cmd)
+	timer.Stop()
+	output.finish()
+
+	elapsed := time.Since(started).Round(time.Millisecond)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = fmt.Errorf("timed out after %v", hooks.timeout)
+	}
+	if err != nil {
+		ControllerWarning.log("The ", hookEnvVar(name), " hook failed after ", elapsed, ": ", err)
+		return err
+	}
+	ControllerInfo.log("The ", hookEnvVar(name), " hook finished in ", elapsed)
+	return nil
+}
+
+// startHook runs the hook in the background unless the controller is shutting down,
+// it is called with or without cmps.mu locked. A manifest of changed files in env is removed once the hook has finished.
+func startHook(name string, env []string) {
+	if hooks.commands[name] == "" {
+		removeChangedFilesManifest(env)
+		return
+	}
+	go func() {
+		defer removeChangedFilesManifest(env)
+		cmps.mu.RLock()
+		shuttingDown := cmps.shuttingDown
+		cmps.mu.RUnlock()
+		if !shuttingDown {
+			_ = runHook(name, env)
+		}
+	}()
+}
+
+// isServingProcess returns true if the process type is the server, or the ON_CHANGE process which replaces it
+// when APPSODY_RUN/DEBUG/TEST_KILL is true, it is called with cmps.mu locked
+func isServingProcess(theProcessType ProcessType) bool {
+	return theProcessType == server || (theProcessType == fileWatcher && stopWatchServerOnChange && cmps.pids[server] == 0)
+}
+
+// addEnvironmentVars adds the hook settings of a mode to the effective configuration which is logged at startup
+func (h lifecycleHooks) addEnvironmentVars(mode string, environmentVars map[string]interface{}) {
+	for _, name := range hookNames {
+		environmentVars["APPSODY_"+mode+"_"+name] = h.commands[name]
+	}
+	environmentVars["APPSODY_"+mode+"_HOOK_TIMEOUT"] = h.timeout
+}
+
+// failureHookEnv returns the environment variables passing the pid and exit status of the failed server to the ON_FAILURE hook
+func failureHookEnv(pid int, err error) []string {
+	return append(serverPidEnv(pid), "APPSODY_EXIT_CODE="+strconv.Itoa(exitStatus(err)))
+}
+
+// serverPidEnv returns the environment variable passing the pid of the server to a hook
+func serverPidEnv(pid int) []string {
+	return []string{"APPSODY_SERVER_PID=" + strconv.Itoa(pid)}
+}
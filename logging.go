@@ -0,0 +1,97 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Values for --log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logFormat = logFormatText
+
+// the levels written in the JSON log for each logger
+var logLevels = map[appsodylogger]string{
+	ControllerInfo:    "info",
+	ControllerWarning: "warning",
+	ControllerError:   "error",
+	ControllerFatal:   "fatal",
+	ControllerDebug:   "debug",
+}
+
+// restartCycle identifies the current server start or ON_CHANGE action, it is incremented each time one begins
+var restartCycle int64
+
+// nextRestartCycle starts a new cycle, the log entries which follow carry its ID
+func nextRestartCycle() int64 {
+	return atomic.AddInt64(&restartCycle, 1)
+}
+
+type logEntry struct {
+	Timestamp   string `json:"timestamp"`
+	Level       string `json:"level"`
+	Message     string `json:"message"`
+	Mode        string `json:"mode"`
+	ProcessType string `json:"processType,omitempty"`
+	Pid         int    `json:"pid,omitempty"`
+	Cycle       int64  `json:"cycle"`
+}
+
+var jsonLogMu sync.Mutex
+
+// logProcess logs a message about one of the controller managed processes, the JSON log records its process type and pid
+func (l appsodylogger) logProcess(theProcessType ProcessType, pid int, args ...interface{}) {
+	if logFormat == logFormatJSON {
+		l.logJSON(eventProcessTypes[theProcessType], pid, args...)
+		return
+	}
+	l.log(args...)
+}
+
+// logJSON writes one log entry as a line of JSON to stderr, where klog writes the text log
+func (l appsodylogger) logJSON(processType string, pid int, args ...interface{}) {
+	if l == ControllerDebug && !klog.V(2) {
+		// we don't want to print out debug unless debug level is set
+		return
+	}
+	entry := logEntry{
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       logLevels[l],
+		Message:     strings.TrimSpace(fmt.Sprint(args...)),
+		Mode:        controllerMode,
+		ProcessType: processType,
+		Pid:         pid,
+		Cycle:       atomic.LoadInt64(&restartCycle),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	jsonLogMu.Lock()
+	defer jsonLogMu.Unlock()
+	_, _ = os.Stderr.Write(append(data, '\n'))
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -44,18 +45,62 @@ var appsodyINSTALL string // Note this will be deprecated in a future release
 var appsodyMOUNTS []string
 
 var appsodyWATCHREGEX string
+var appsodyPREPWATCHREGEX string
+var appsodyPREPCACHEINPUTS []string
+var appsodyPREPCACHEDIR string
+var appsodyPREPSTEPS []prepStep
+var appsodyPREPTIMEOUT time.Duration
+var appsodyPREPRETRIES int
 var appsodyPREP string
 var appsodyWATCHINTERVAL time.Duration
+var appsodyWATCHBACKEND string
+var appsodyWATCHDEBOUNCE time.Duration
+var appsodyONCHANGEPOLICY string
+var appsodyONCHANGEMAXQUEUE int
 var appsodyDEBUGWATCHACTION string
 var appsodyTESTWATCHACTION string
+var appsodyRUNBUILD string
+var appsodyDEBUGBUILD string
+var appsodyTESTBUILD string
 var appsodyRUNKILL bool
 var appsodyDEBUGKILL bool
 var appsodyTESTKILL bool
+var appsodyRUNRESTART string
+var appsodyDEBUGRESTART string
+var appsodyTESTRESTART string
+var appsodyRESTARTMAXRETRIES int
+var appsodyRESTARTBACKOFF time.Duration
+var appsodyRUNSTOPSIGNAL syscall.Signal
+var appsodyDEBUGSTOPSIGNAL syscall.Signal
+var appsodyTESTSTOPSIGNAL syscall.Signal
+var appsodyRUNSTOPTIMEOUT time.Duration
+var appsodyDEBUGSTOPTIMEOUT time.Duration
+var appsodyTESTSTOPTIMEOUT time.Duration
+var appsodyRUNRELOADSIGNAL syscall.Signal
+var appsodyDEBUGRELOADSIGNAL syscall.Signal
+var appsodyTESTRELOADSIGNAL syscall.Signal
+var appsodyRUNEXITONSERVEREXIT bool
+var appsodyDEBUGEXITONSERVEREXIT bool
+var appsodyTESTEXITONSERVEREXIT bool
+var appsodyRUNHOOKS lifecycleHooks
+var appsodyDEBUGHOOKS lifecycleHooks
+var appsodyTESTHOOKS lifecycleHooks
+var appsodyREADINESSPROBE *probeConfig
+var appsodyLIVENESSPROBE *probeConfig
+var appsodyOUTPUTPREFIX bool
+var appsodyOUTPUTTIMESTAMP bool
+var appsodyOUTPUTCOLOR string
+var appsodyMETRICSADDRESS string
+var appsodyPROCESSTRACKING string
+var appsodyFORWARDSIGNALS []syscall.Signal
 var workDir string
 var klogFlags *flag.FlagSet
 var verbose bool
 var version bool
 var interactiveFlag bool
+var disableWatcher bool
+var checkConfig bool
+var forcePrep bool
 var vmode bool
 
 type ProcessType int
@@ -63,24 +108,40 @@ type ProcessType int
 const (
 	server      ProcessType = 0
 	fileWatcher ProcessType = 1
+	build       ProcessType = 2
+	prep        ProcessType = 3
 )
 
 func processTypeToString(theProcessType ProcessType) string {
 	if theProcessType == 0 {
 		return "APPSODY_RUN/DEBUG/TEST"
 	}
+	if theProcessType == build {
+		return "APPSODY_RUN/DEBUG/TEST_BUILD"
+	}
+	if theProcessType == prep {
+		return "APPSODY_PREP"
+	}
 	return "APPSODY_RUN/DEBUG/TEST_ON_CHANGE"
 }
 
 type controllerManagedProcesses struct {
-	pids      map[ProcessType]int
-	processes map[ProcessType]*os.Process
-	mu        sync.RWMutex
+	pids             map[ProcessType]int
+	processes        map[ProcessType]*os.Process
+	exitCodes        map[ProcessType]int
+	restartRequested string // the restart reason when the server is restarted by the control API or the liveness probe
+	shuttingDown     bool
+	serverRestarting bool       // an ON_CHANGE action is restarting the server, it has been applied once the server has started
+	stopping         int        // the number of processes taken out by detachProcess which are still being stopped
+	stopped          *sync.Cond // signalled on mu when one of them has stopped
+	mu               sync.RWMutex
 }
 
 var (
 	cmps *controllerManagedProcesses
 	once sync.Once
+	// shutdownOnce makes sure the managed processes are only stopped by the first shutdown
+	shutdownOnce sync.Once
 )
 
 func appsodyControllerManagedProcesses() *controllerManagedProcesses {
@@ -88,7 +149,9 @@ func appsodyControllerManagedProcesses() *controllerManagedProcesses {
 		cmps = &controllerManagedProcesses{
 			pids:      make(map[ProcessType]int),
 			processes: make(map[ProcessType]*os.Process),
+			exitCodes: make(map[ProcessType]int),
 		}
+		cmps.stopped = sync.NewCond(&cmps.mu)
 	})
 
 	return cmps
@@ -124,6 +187,10 @@ func (e volumesError) Error() string {
 type appsodylogger string
 
 func (l appsodylogger) log(args ...interface{}) {
+	if logFormat == logFormatJSON {
+		l.logJSON("", 0, args...)
+		return
+	}
 	var dbg [1]interface{}
 
 	if l != "Info" {
@@ -166,27 +233,76 @@ type mountError struct {
 func (e mountError) Error() string {
 	return fmt.Sprintf("The Mount string has bad formatting: %v", e.mountsString)
 }
-func computeSigInt(tempSigInt string) bool {
-	var answer bool
-	if tempSigInt == "" || strings.Compare(strings.TrimSpace(strings.ToUpper(tempSigInt)), "TRUE") == 0 {
-
-		answer = true
-	} else {
 
-		answer = false
+// computeSigInt parses an APPSODY_RUN/DEBUG/TEST_KILL value, which defaults to true
+func computeSigInt(envVar string, tempSigInt string) (bool, error) {
+	switch strings.TrimSpace(strings.ToUpper(tempSigInt)) {
+	case "", "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
 	}
-	return answer
+	return true, configError{envVar, tempSigInt, "Must be true or false"}
 }
+
+// setupEnvironmentVars reads and validates every environment variable, all of the problems found are returned together as configErrors
 func setupEnvironmentVars() error {
 
 	var err error
+	var problems configErrors
 
 	tmpWATCHIGNOREDIR := os.Getenv("APPSODY_WATCH_IGNORE_DIR")
-	appsodyRUNKILL = computeSigInt(os.Getenv("APPSODY_RUN_KILL"))
-	appsodyDEBUGKILL = computeSigInt(os.Getenv("APPSODY_DEBUG_KILL"))
-	appsodyTESTKILL = computeSigInt(os.Getenv("APPSODY_TEST_KILL"))
+	appsodyRUNKILL, err = computeSigInt("APPSODY_RUN_KILL", os.Getenv("APPSODY_RUN_KILL"))
+	problems.add(err)
+	appsodyDEBUGKILL, err = computeSigInt("APPSODY_DEBUG_KILL", os.Getenv("APPSODY_DEBUG_KILL"))
+	problems.add(err)
+	appsodyTESTKILL, err = computeSigInt("APPSODY_TEST_KILL", os.Getenv("APPSODY_TEST_KILL"))
+	problems.add(err)
+	appsodyRUNRESTART, err = computeRestartPolicy("APPSODY_RUN_RESTART", os.Getenv("APPSODY_RUN_RESTART"))
+	problems.add(err)
+	appsodyDEBUGRESTART, err = computeRestartPolicy("APPSODY_DEBUG_RESTART", os.Getenv("APPSODY_DEBUG_RESTART"))
+	problems.add(err)
+	appsodyTESTRESTART, err = computeRestartPolicy("APPSODY_TEST_RESTART", os.Getenv("APPSODY_TEST_RESTART"))
+	problems.add(err)
+	appsodyRESTARTMAXRETRIES, err = computeRestartMaxRetries(os.Getenv("APPSODY_RESTART_MAX_RETRIES"))
+	problems.add(err)
+	appsodyRESTARTBACKOFF, err = computeRestartBackoff(os.Getenv("APPSODY_RESTART_BACKOFF"))
+	problems.add(err)
+	appsodyRUNSTOPSIGNAL, err = computeStopSignal("APPSODY_RUN_STOP_SIGNAL", os.Getenv("APPSODY_RUN_STOP_SIGNAL"))
+	problems.add(err)
+	appsodyDEBUGSTOPSIGNAL, err = computeStopSignal("APPSODY_DEBUG_STOP_SIGNAL", os.Getenv("APPSODY_DEBUG_STOP_SIGNAL"))
+	problems.add(err)
+	appsodyTESTSTOPSIGNAL, err = computeStopSignal("APPSODY_TEST_STOP_SIGNAL", os.Getenv("APPSODY_TEST_STOP_SIGNAL"))
+	problems.add(err)
+	appsodyRUNSTOPTIMEOUT, err = computeStopTimeout("APPSODY_RUN_STOP_TIMEOUT", os.Getenv("APPSODY_RUN_STOP_TIMEOUT"))
+	problems.add(err)
+	appsodyDEBUGSTOPTIMEOUT, err = computeStopTimeout("APPSODY_DEBUG_STOP_TIMEOUT", os.Getenv("APPSODY_DEBUG_STOP_TIMEOUT"))
+	problems.add(err)
+	appsodyTESTSTOPTIMEOUT, err = computeStopTimeout("APPSODY_TEST_STOP_TIMEOUT", os.Getenv("APPSODY_TEST_STOP_TIMEOUT"))
+	problems.add(err)
+	appsodyRUNRELOADSIGNAL, err = computeReloadSignal("APPSODY_RUN_RELOAD_SIGNAL", os.Getenv("APPSODY_RUN_RELOAD_SIGNAL"))
+	problems.add(err)
+	appsodyDEBUGRELOADSIGNAL, err = computeReloadSignal("APPSODY_DEBUG_RELOAD_SIGNAL", os.Getenv("APPSODY_DEBUG_RELOAD_SIGNAL"))
+	problems.add(err)
+	appsodyTESTRELOADSIGNAL, err = computeReloadSignal("APPSODY_TEST_RELOAD_SIGNAL", os.Getenv("APPSODY_TEST_RELOAD_SIGNAL"))
+	problems.add(err)
+	appsodyRUNEXITONSERVEREXIT, err = computeBoolean("APPSODY_RUN_EXIT_ON_SERVER_EXIT", os.Getenv("APPSODY_RUN_EXIT_ON_SERVER_EXIT"), false)
+	problems.add(err)
+	appsodyDEBUGEXITONSERVEREXIT, err = computeBoolean("APPSODY_DEBUG_EXIT_ON_SERVER_EXIT", os.Getenv("APPSODY_DEBUG_EXIT_ON_SERVER_EXIT"), false)
+	problems.add(err)
+	appsodyTESTEXITONSERVEREXIT, err = computeBoolean("APPSODY_TEST_EXIT_ON_SERVER_EXIT", os.Getenv("APPSODY_TEST_EXIT_ON_SERVER_EXIT"), false)
+	problems.add(err)
+	appsodyRUNHOOKS, err = computeHooks("RUN")
+	problems.add(err)
+	appsodyDEBUGHOOKS, err = computeHooks("DEBUG")
+	problems.add(err)
+	appsodyTESTHOOKS, err = computeHooks("TEST")
+	problems.add(err)
 	appsodyDEBUGWATCHACTION = os.Getenv("APPSODY_DEBUG_ON_CHANGE")
 	appsodyTESTWATCHACTION = os.Getenv("APPSODY_TEST_ON_CHANGE")
+	appsodyRUNBUILD = os.Getenv("APPSODY_RUN_BUILD")
+	appsodyDEBUGBUILD = os.Getenv("APPSODY_DEBUG_BUILD")
+	appsodyTESTBUILD = os.Getenv("APPSODY_TEST_BUILD")
 	appsodyTEST = os.Getenv("APPSODY_TEST")
 	appsodyWATCHREGEX = os.Getenv("APPSODY_WATCH_REGEX")
 
@@ -194,6 +310,8 @@ func setupEnvironmentVars() error {
 	if appsodyWATCHREGEX == "" {
 		appsodyWATCHREGEX = "(^.*.java$)|(^.*.js$)|(^.*.go$)"
 	}
+	problems.add(validateRegex("APPSODY_WATCH_REGEX", appsodyWATCHREGEX, appsodyWATCHREGEX))
+	appsodyPREPWATCHREGEX = os.Getenv("APPSODY_PREP_WATCH_REGEX")
 
 	appsodyRUN = os.Getenv("APPSODY_RUN")
 	tmpWatchDirs := os.Getenv("APPSODY_WATCH_DIR")
@@ -203,47 +321,101 @@ func setupEnvironmentVars() error {
 
 	if appsodyPREP == "" {
 		appsodyPREP = appsodyINSTALL
+	} else if appsodyINSTALL != "" && appsodyINSTALL != appsodyPREP {
+		ControllerWarning.log("APPSODY_INSTALL is deprecated, it is ignored as APPSODY_PREP is set to a different command. Remove APPSODY_INSTALL: ", appsodyINSTALL)
+	}
+	appsodyPREPTIMEOUT, err = computePrepTimeout("APPSODY_PREP_TIMEOUT", os.Getenv("APPSODY_PREP_TIMEOUT"))
+	problems.add(err)
+	appsodyPREPRETRIES, err = computeWholeNumber("APPSODY_PREP_RETRIES", os.Getenv("APPSODY_PREP_RETRIES"), 0, 0, "retries")
+	problems.add(err)
+	appsodyPREPSTEPS, err = computePrepSteps("APPSODY_PREP", appsodyPREP, appsodyPREPTIMEOUT, appsodyPREPRETRIES)
+	problems.add(err)
+	// the files which APPSODY_PREP depends on, it is skipped if they are unchanged since it last succeeded
+	appsodyPREPCACHEINPUTS = nil
+	for _, input := range strings.Split(os.Getenv("APPSODY_PREP_CACHE_INPUTS"), ";") {
+		if input = strings.TrimSpace(input); input != "" {
+			appsodyPREPCACHEINPUTS = append(appsodyPREPCACHEINPUTS, input)
+		}
+	}
+	appsodyPREPCACHEDIR = strings.TrimSpace(os.Getenv("APPSODY_PREP_CACHE_DIR"))
+	if appsodyPREPCACHEDIR == "" {
+		appsodyPREPCACHEDIR = defaultPrepCacheDir
+	}
+	if err = validatePrepWatch("APPSODY_PREP_WATCH_REGEX", appsodyPREPWATCHREGEX, appsodyPREP); err != nil {
+		problems.add(err)
+	} else if prepWatchConfigured() {
+		prepWatchRegex = regexp.MustCompile(appsodyPREPWATCHREGEX)
 	}
 
 	appsodyDEBUG = os.Getenv("APPSODY_DEBUG")
 
 	tmpMountDirs := os.Getenv("APPSODY_MOUNTS")
 
-	tempWatchInterval := os.Getenv("APPSODY_WATCH_INTERVAL")
-
-	var value int
-	var atoiErr error
-	if tempWatchInterval != "" {
-		trimmedInterval := strings.TrimSpace(tempWatchInterval)
-		value, atoiErr = strconv.Atoi(trimmedInterval)
-
-		if atoiErr != nil {
-
-			ControllerWarning.log("Invalid watch interval, setting to default 2000: " + tempWatchInterval)
-
-			value = 2
-		}
+	// the watch interval is in seconds
+	watchInterval, err := computeWholeNumber("APPSODY_WATCH_INTERVAL", os.Getenv("APPSODY_WATCH_INTERVAL"), 2, 1, "seconds")
+	problems.add(err)
+	appsodyWATCHINTERVAL = time.Duration(int64(watchInterval) * int64(time.Second))
+
+	// the debounce period is in milliseconds, 0 runs the ON_CHANGE action for every file event
+	watchDebounce, err := computeWholeNumber("APPSODY_WATCH_DEBOUNCE", os.Getenv("APPSODY_WATCH_DEBOUNCE"), 0, 0, "milliseconds")
+	problems.add(err)
+	appsodyWATCHDEBOUNCE = time.Duration(watchDebounce) * time.Millisecond
+
+	// how a change is handled while an ON_CHANGE action is running
+	appsodyONCHANGEPOLICY, err = computeOnChangePolicy("APPSODY_ON_CHANGE_POLICY", os.Getenv("APPSODY_ON_CHANGE_POLICY"))
+	problems.add(err)
+	appsodyONCHANGEMAXQUEUE, err = computeWholeNumber("APPSODY_ON_CHANGE_MAX_QUEUE", os.Getenv("APPSODY_ON_CHANGE_MAX_QUEUE"), defaultOnChangeMaxQueue, 1, "queued actions")
+	problems.add(err)
+
+	appsodyREADINESSPROBE, err = setupProbe("readiness", "APPSODY_READINESS_PROBE")
+	problems.add(err)
+	appsodyLIVENESSPROBE, err = setupProbe("liveness", "APPSODY_LIVENESS_PROBE")
+	problems.add(err)
+	if appsodyLIVENESSPROBE != nil && appsodyLIVENESSPROBE.kind == probeLog {
+		problems.add(configError{"APPSODY_LIVENESS_PROBE", os.Getenv("APPSODY_LIVENESS_PROBE"), "A log probe can only be used as the readiness probe"})
+		appsodyLIVENESSPROBE = nil
+	}
 
-	} else {
-		// default to 2 seconds
-		value = 2
+	appsodyOUTPUTPREFIX, err = computeBoolean("APPSODY_OUTPUT_PREFIX", os.Getenv("APPSODY_OUTPUT_PREFIX"), false)
+	problems.add(err)
+	appsodyOUTPUTTIMESTAMP, err = computeBoolean("APPSODY_OUTPUT_TIMESTAMP", os.Getenv("APPSODY_OUTPUT_TIMESTAMP"), false)
+	problems.add(err)
+	appsodyOUTPUTCOLOR, err = computeOutputColor("APPSODY_OUTPUT_COLOR", os.Getenv("APPSODY_OUTPUT_COLOR"))
+	problems.add(err)
+
+	appsodyPROCESSTRACKING, err = computeProcessTracking("APPSODY_PROCESS_TRACKING", os.Getenv("APPSODY_PROCESS_TRACKING"))
+	problems.add(err)
+	appsodyFORWARDSIGNALS, err = computeForwardSignals("APPSODY_FORWARD_SIGNALS", os.Getenv("APPSODY_FORWARD_SIGNALS"))
+	problems.add(err)
+	appsodyMETRICSADDRESS = strings.TrimSpace(os.Getenv("APPSODY_METRICS_ADDRESS"))
+	problems.add(validateMetricsAddress("APPSODY_METRICS_ADDRESS", appsodyMETRICSADDRESS))
+
+	tmpWatchBackend := os.Getenv("APPSODY_WATCH_BACKEND")
+	appsodyWATCHBACKEND = strings.ToLower(strings.TrimSpace(tmpWatchBackend))
+	switch appsodyWATCHBACKEND {
+	case watchBackendAuto, watchBackendInotify, watchBackendPoll:
+	case "":
+		appsodyWATCHBACKEND = watchBackendAuto
+	default:
+		problems.add(configError{"APPSODY_WATCH_BACKEND", tmpWatchBackend, "The watch backend must be one of auto, inotify or poll"})
+		appsodyWATCHBACKEND = watchBackendAuto
 	}
 
-	appsodyWATCHINTERVAL = time.Duration(int64(value) * int64(time.Second))
+	problems.add(validateBuild("RUN", appsodyRUNBUILD, appsodyRUNWATCHACTION, appsodyRUNRELOADSIGNAL))
+	problems.add(validateBuild("DEBUG", appsodyDEBUGBUILD, appsodyDEBUGWATCHACTION, appsodyDEBUGRELOADSIGNAL))
+	problems.add(validateBuild("TEST", appsodyTESTBUILD, appsodyTESTWATCHACTION, appsodyTESTRELOADSIGNAL))
 
 	fileWatchingOff := false
-	if appsodyRUNWATCHACTION == "" && appsodyDEBUGWATCHACTION == "" && appsodyTESTWATCHACTION == "" {
+	if appsodyRUNWATCHACTION == "" && appsodyDEBUGWATCHACTION == "" && appsodyTESTWATCHACTION == "" &&
+		appsodyRUNRELOADSIGNAL == 0 && appsodyDEBUGRELOADSIGNAL == 0 && appsodyTESTRELOADSIGNAL == 0 && !prepWatchConfigured() {
 		ControllerDebug.log("File watching is not enabled.")
 		fileWatchingOff = true
 	}
 
 	if appsodyDEBUG == "" && appsodyRUN == "" && appsodyTEST == "" {
-		err = envError{"APPSODY_DEBUG", "APPSODY_RUN", "APPSODY_TEST"}
-		return err
+		problems.add(envError{"APPSODY_DEBUG", "APPSODY_RUN", "APPSODY_TEST"})
 	} else if !fileWatchingOff && tmpMountDirs == "" && tmpWatchDirs == "" {
-		err = volumesError{"APPSODY_WATCH_DIR", "APPSODY_MOUNTS"}
-		return err
-
+		problems.add(volumesError{"APPSODY_WATCH_DIR", "APPSODY_MOUNTS"})
 	}
 
 	// split the watch dirs using ; separator
@@ -261,7 +433,8 @@ func setupEnvironmentVars() error {
 		appsodyWATCHIGNOREDIR = strings.Split(tmpWATCHIGNOREDIR, ";")
 		for i := 0; i < len(appsodyWATCHIGNOREDIR); i++ {
 			appsodyWATCHIGNOREDIR[i] = strings.TrimSpace(appsodyWATCHIGNOREDIR[i])
-
+			// the ignore dirs are matched as regular expressions anchored at the start of the path
+			problems.add(validateRegex("APPSODY_WATCH_IGNORE_DIR", tmpWATCHIGNOREDIR, "^"+appsodyWATCHIGNOREDIR[i]))
 		}
 
 	}
@@ -278,7 +451,7 @@ func setupEnvironmentVars() error {
 				//ex. C:\whatever\path\:/linux/dir
 				appsodyMOUNTS[i] = strings.TrimSpace(localDir[len(localDir)-1])
 			} else {
-				err = mountError{tmpMountDirs}
+				problems.add(mountError{tmpMountDirs})
 				break
 			}
 
@@ -286,6 +459,15 @@ func setupEnvironmentVars() error {
 
 	}
 
+	// the watched directories must exist if the file watcher runs in this mode
+	if (modeWatchAction(controllerMode) != "" || modeReloadSignal(controllerMode) != 0 || prepWatchConfigured()) && !disableWatcher {
+		if appsodyWATCHDIRS != nil {
+			problems = append(problems, validateWatchDirs("APPSODY_WATCH_DIR", tmpWatchDirs, appsodyWATCHDIRS)...)
+		} else if appsodyMOUNTS != nil {
+			problems = append(problems, validateWatchDirs("APPSODY_MOUNTS", tmpMountDirs, appsodyMOUNTS)...)
+		}
+	}
+
 	environmentVars := make(map[string]interface{})
 
 	environmentVars["APPSODY_WATCH_IGNORE_DIR"] = tmpWATCHIGNOREDIR
@@ -296,133 +478,257 @@ func setupEnvironmentVars() error {
 	environmentVars["APPSODY_RUN_KILL"] = appsodyRUNKILL
 	environmentVars["APPSODY_DEBUG_KILL"] = appsodyDEBUGKILL
 	environmentVars["APPSODY_TEST_KILL"] = appsodyTESTKILL
+	environmentVars["APPSODY_RUN_RESTART"] = appsodyRUNRESTART
+	environmentVars["APPSODY_DEBUG_RESTART"] = appsodyDEBUGRESTART
+	environmentVars["APPSODY_TEST_RESTART"] = appsodyTESTRESTART
+	environmentVars["APPSODY_RESTART_MAX_RETRIES"] = appsodyRESTARTMAXRETRIES
+	environmentVars["APPSODY_RESTART_BACKOFF"] = appsodyRESTARTBACKOFF
+	environmentVars["APPSODY_RUN_STOP_SIGNAL"] = signalName(appsodyRUNSTOPSIGNAL)
+	environmentVars["APPSODY_DEBUG_STOP_SIGNAL"] = signalName(appsodyDEBUGSTOPSIGNAL)
+	environmentVars["APPSODY_TEST_STOP_SIGNAL"] = signalName(appsodyTESTSTOPSIGNAL)
+	environmentVars["APPSODY_RUN_STOP_TIMEOUT"] = appsodyRUNSTOPTIMEOUT
+	environmentVars["APPSODY_DEBUG_STOP_TIMEOUT"] = appsodyDEBUGSTOPTIMEOUT
+	environmentVars["APPSODY_TEST_STOP_TIMEOUT"] = appsodyTESTSTOPTIMEOUT
+	environmentVars["APPSODY_RUN_RELOAD_SIGNAL"] = reloadSignalName(appsodyRUNRELOADSIGNAL)
+	environmentVars["APPSODY_DEBUG_RELOAD_SIGNAL"] = reloadSignalName(appsodyDEBUGRELOADSIGNAL)
+	environmentVars["APPSODY_TEST_RELOAD_SIGNAL"] = reloadSignalName(appsodyTESTRELOADSIGNAL)
+	environmentVars["APPSODY_RUN_EXIT_ON_SERVER_EXIT"] = appsodyRUNEXITONSERVEREXIT
+	environmentVars["APPSODY_DEBUG_EXIT_ON_SERVER_EXIT"] = appsodyDEBUGEXITONSERVEREXIT
+	environmentVars["APPSODY_TEST_EXIT_ON_SERVER_EXIT"] = appsodyTESTEXITONSERVEREXIT
+	appsodyRUNHOOKS.addEnvironmentVars("RUN", environmentVars)
+	appsodyDEBUGHOOKS.addEnvironmentVars("DEBUG", environmentVars)
+	appsodyTESTHOOKS.addEnvironmentVars("TEST", environmentVars)
 	environmentVars["APPSODY_RUN_ON_CHANGE"] = appsodyRUNWATCHACTION
 	environmentVars["APPSODY_DEBUG_ON_CHANGE"] = appsodyDEBUGWATCHACTION
 	environmentVars["APPSODY_TEST_ON_CHANGE"] = appsodyTESTWATCHACTION
+	environmentVars["APPSODY_RUN_BUILD"] = appsodyRUNBUILD
+	environmentVars["APPSODY_DEBUG_BUILD"] = appsodyDEBUGBUILD
+	environmentVars["APPSODY_TEST_BUILD"] = appsodyTESTBUILD
 	environmentVars["APPSODY_WATCH_DIR"] = tmpWatchDirs
 	environmentVars["APPSODY_MOUNTS"] = tmpMountDirs
 	environmentVars["APPSODY_INSTALL"] = appsodyINSTALL
 	environmentVars["APPSODY_PREP"] = appsodyPREP
 	environmentVars["APPSODY_WATCH_INTERVAL"] = appsodyWATCHINTERVAL
+	environmentVars["APPSODY_WATCH_BACKEND"] = appsodyWATCHBACKEND
+	environmentVars["APPSODY_WATCH_DEBOUNCE"] = appsodyWATCHDEBOUNCE
+	environmentVars["APPSODY_ON_CHANGE_POLICY"] = appsodyONCHANGEPOLICY
+	environmentVars["APPSODY_ON_CHANGE_MAX_QUEUE"] = appsodyONCHANGEMAXQUEUE
 	environmentVars["APPSODY_WATCH_REGEX"] = appsodyWATCHREGEX
-	ControllerDebug.log("Appsody Controller environment variables: ", environmentVars)
-
-	return err
-}
-
-func killProcess(theProcessType ProcessType, checkAttempts int) error {
-	var processPid int
-	var err error
-	if theProcessType == server {
-		processPid = cmps.pids[server]
+	environmentVars["APPSODY_PREP_WATCH_REGEX"] = appsodyPREPWATCHREGEX
+	environmentVars["APPSODY_PREP_CACHE_INPUTS"] = appsodyPREPCACHEINPUTS
+	environmentVars["APPSODY_PREP_CACHE_DIR"] = appsodyPREPCACHEDIR
+	environmentVars["APPSODY_PREP_TIMEOUT"] = appsodyPREPTIMEOUT
+	environmentVars["APPSODY_PREP_RETRIES"] = appsodyPREPRETRIES
+	environmentVars["APPSODY_READINESS_PROBE"] = appsodyREADINESSPROBE
+	environmentVars["APPSODY_LIVENESS_PROBE"] = appsodyLIVENESSPROBE
+	environmentVars["APPSODY_OUTPUT_PREFIX"] = appsodyOUTPUTPREFIX
+	environmentVars["APPSODY_OUTPUT_TIMESTAMP"] = appsodyOUTPUTTIMESTAMP
+	environmentVars["APPSODY_OUTPUT_COLOR"] = appsodyOUTPUTCOLOR
+	environmentVars["APPSODY_METRICS_ADDRESS"] = appsodyMETRICSADDRESS
+	environmentVars["APPSODY_PROCESS_TRACKING"] = appsodyPROCESSTRACKING
+	environmentVars["APPSODY_FORWARD_SIGNALS"] = signalNames(appsodyFORWARDSIGNALS)
+	if configFile != "" {
+		ControllerInfo.log("Effective Appsody Controller configuration: ", environmentVars)
 	} else {
-		processPid = cmps.pids[theProcessType]
+		ControllerDebug.log("Appsody Controller environment variables: ", environmentVars)
 	}
-	ControllerDebug.log("Attempting to kill pid: ", processPid)
-
-	if processPid != 0 {
-		// Check to see if the process is still alive to avoid unncessary kill steps
-		if cmps.processes[theProcessType].Signal(syscall.Signal(0)) != nil {
-			ControllerDebug.log("No such process for pid:  ", processPid)
-			err = nil
-		} else {
 
-			ControllerDebug.log("Killing pid:  ", -processPid)
-			err = syscall.Kill(-processPid, syscall.SIGINT)
-			// If checkAttempts speified check and wait to make sure process was killed.
-			for i := 0; i < checkAttempts; i++ {
-				ControllerDebug.log("Process check ", theProcessType, i)
-				if cmps.processes[theProcessType].Signal(syscall.Signal(0)) != nil {
-					break //process is dead
-				} else {
-					time.Sleep(2 * time.Second)
-				}
-			}
-		}
-		cmps.processes[theProcessType] = nil
-		cmps.pids[theProcessType] = 0
-		if err != nil {
-
-			ControllerError.log("Killing process ", processPid, " returned an error SIGINT received error ", err)
-
-		}
+	if len(problems) > 0 {
+		return problems
 	}
-	return err
+	return nil
 }
 
 /*
-	runPrep
+	runPrep runs the APPSODY_PREP steps in order, stopping at the first step which fails
+	errPrepCancelled is returned if a newer run or the controller shutdown stopped it
 */
-func runPrep(commandString string, interactive bool) (*exec.Cmd, error) {
+func runPrep(interactive bool, env []string) error {
+	cmps.mu.Lock()
+	prepGeneration++
+	generation := prepGeneration
+	prepRunning = true
+	cmps.mu.Unlock()
+
+	if isPrepStepList(strings.TrimSpace(appsodyPREP)) {
+		names := make([]string, len(appsodyPREPSTEPS))
+		for i, step := range appsodyPREPSTEPS {
+			names[i] = step.name
+		}
+		ControllerInfo.log("Running the APPSODY_PREP steps: " + strings.Join(names, ", "))
+	} else {
+		ControllerInfo.log("Running APPSODY_PREP command: " + appsodyPREP)
+	}
+	started := time.Now()
+	var results []prepStepResult
 	var err error
-	cmd := exec.Command("/bin/sh", "-c", commandString)
-	ControllerDebug.log("Set workdir:  " + workDir)
-	cmd.Dir = workDir
-	if interactive {
-		cmd.Stdin = os.Stdin
+	for _, step := range appsodyPREPSTEPS {
+		result := runPrepStep(step, generation, interactive, env)
+		results = append(results, result)
+		if result.err != nil {
+			err = result.err
+			if err != errPrepCancelled {
+				err = prepFailure{result}
+			}
+			break
+		}
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
-	ControllerInfo.log("Running APPSODY_PREP command: " + commandString)
-	err = cmd.Run()
 
-	return cmd, err
+	cmps.mu.Lock()
+	if prepGeneration == generation {
+		prepRunning = false
+	}
+	cmps.mu.Unlock()
+	if err == errPrepCancelled {
+		return err
+	}
+	elapsed := time.Since(started)
+	metricPrepDuration.observe(elapsed)
+	exitCode := prepExitCode(err)
+	publishEvent(controllerEvent{Type: eventPrepFinished, ProcessType: eventProcessTypes[prep], ExitCode: &exitCode})
+	if len(appsodyPREPSTEPS) > 1 || err != nil {
+		logPrepSummary(results, elapsed)
+	}
+	return err
 }
 
 /*
 	StartProcess
 */
-func startProcess(commandString string, theProcessType ProcessType, interactive bool) (*exec.Cmd, error) {
+func startProcess(commandString string, theProcessType ProcessType, interactive bool, env []string) (*exec.Cmd, error) {
 	var err error
 	cmd := exec.Command("/bin/sh", "-c", commandString)
 	ControllerDebug.log("Set workdir:  " + workDir)
 	cmd.Dir = workDir
+	marker := newProcessMarker()
+	if marker != "" {
+		env = append(env[:len(env):len(env)], marker)
+	}
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	if interactive {
 		cmd.Stdin = os.Stdin
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// the previous process of this type exited on its own without being stopped
+	stopLeftovers(cmps.pids[theProcessType], theProcessType)
+
+	var probes *probeRunner
+	var logProbe io.Writer
+	if probedProcess(theProcessType) {
+		probes = newProbeRunner()
+		logProbe = probes.logWriter()
+	}
+	setProcessOutput(cmd, outputRole(theProcessType), logProbe)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
-	ControllerInfo.log("Running command:  " + commandString)
-	err = cmd.Start()
+	ControllerInfo.logProcess(theProcessType, 0, "Running command:  "+commandString)
+	err = startChild(cmd)
+	processOutputStarted(cmd, err)
+	if err == nil {
+		trackProcessTree(cmd.Process.Pid, marker, theProcessType)
+	}
 
 	cmps.processes[theProcessType] = cmd.Process
 
 	cmps.pids[theProcessType] = cmd.Process.Pid
-	ControllerDebug.log("New process created with pid ", strconv.Itoa(cmd.Process.Pid))
+	ControllerDebug.logProcess(theProcessType, cmd.Process.Pid, "New process created with pid ", strconv.Itoa(cmd.Process.Pid))
+	publishProcessEvent(eventProcessStarted, theProcessType, cmd.Process.Pid)
+	if probes != nil {
+		probes.start(cmd.Process.Pid)
+	}
 
 	return cmd, err
 }
 
 func waitProcess(cmd *exec.Cmd, theProcessType ProcessType) error {
 
-	err := cmd.Wait()
+	err := waitChild(cmd)
+	flushProcessOutput(cmd)
+	if probedProcess(theProcessType) {
+		stopServerProbes(cmd.Process.Pid)
+	}
+
+	// record the exit code so that it can be reported by the control API
+	exitCode := exitCodeFromError(err)
+	cmps.mu.Lock()
+	cmps.exitCodes[theProcessType] = exitCode
+	cmps.mu.Unlock()
+	recordExit(theProcessType, cmd.Process.Pid, err)
+	metricProcessExits.inc(eventProcessTypes[theProcessType], strconv.Itoa(exitCode))
+	publishEvent(controllerEvent{Type: eventProcessExited, ProcessType: eventProcessTypes[theProcessType], Pid: cmd.Process.Pid, ExitCode: &exitCode})
 
 	return err
 }
 
+// exitCodeFromError returns the exit code for the error returned by cmd.Wait
+// -1 is returned if the exit code can not be determined, for instance when the process was killed by a signal
+func exitCodeFromError(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
 func runWatcher(fileChangeCommand string, dirs []string, killServer bool, interactive bool) error {
-	errorMessage := ""
 	var err error
 
 	ControllerDebug.log("Starting watcher")
 	// Start the Watcher
 	// compile the regex prior to running watcher because panic leaves child processes if it occurs
 
-	r := regexp.MustCompile(appsodyWATCHREGEX)
-	w := watcher.New()
+	r := regexp.MustCompile(watchedFilesRegex())
+	var ignoredDirs []*regexp.Regexp
 	for _, ignoredir := range appsodyWATCHIGNOREDIR {
-		r1 := regexp.MustCompile("^" + ignoredir)
+		ignoredDirs = append(ignoredDirs, regexp.MustCompile("^"+ignoredir))
+	}
+	if r := prepCacheIgnoredDir(); r != nil {
+		ignoredDirs = append(ignoredDirs, r)
+	}
+
+	backend := selectWatchBackend(appsodyWATCHBACKEND, dirs)
+	for {
+		err = watchDirs(backend, r, ignoredDirs, fileChangeCommand, dirs, killServer, interactive)
+		if err == errWatchFallback && appsodyWATCHBACKEND == watchBackendAuto && backend != watchBackendPoll {
+			ControllerWarning.log("The inotify file watcher is unavailable, falling back to polling for file changes. ", err)
+			backend = watchBackendPoll
+			continue
+		}
+		if err == errWatchFallback {
+			// polling is only used in place of inotify in auto mode
+			return fmt.Errorf("APPSODY_WATCH_BACKEND is %v but the inotify file watcher is unavailable, set it to auto or poll to use polling: %v", appsodyWATCHBACKEND, err)
+		}
+		return err
+	}
+}
+
+// watchDirs runs the file watcher for the backend until it is closed
+// errWatchFallback is returned if the inotify watcher can not be used
+func watchDirs(backend string, r *regexp.Regexp, ignoredDirs []*regexp.Regexp, fileChangeCommand string, dirs []string, killServer bool, interactive bool) error {
+	errorMessage := ""
+
+	ControllerDebug.log("Using the ", backend, " file watcher")
+	w, err := newWatchBackend(backend, ignoredDirs)
+	if err != nil {
+		ControllerWarning.log("Could not create the ", backend, " file watcher ", err)
+		return errWatchFallback
+	}
+	for _, r1 := range ignoredDirs {
 		w.AddFilterHook(watcher.NegativeFilterHook(r1, true))
 	}
 	// These filter hooks MUST be added prior do adding recursive directories
 	// otherwise there is a timing window at startup and unwanted events will be proccessed.
 	w.AddFilterHook(watcher.NoDirectoryFilterHook())
 	w.AddFilterHook(watcher.RegexFilterHook(r, false))
-	w.SetMaxEvents(1)
+	if appsodyWATCHDEBOUNCE > 0 {
+		// every event is needed to know when the tree has been quiet for the debounce period
+		w.SetMaxEvents(0)
+	} else {
+		w.SetMaxEvents(1)
+	}
 	for d := 0; d < len(dirs); d++ {
 		// Watch each directory specified recursively for changes.
 		currentDir := dirs[d]
@@ -435,6 +741,10 @@ func runWatcher(fileChangeCommand string, dirs []string, killServer bool, intera
 
 		}
 		if err = w.AddRecursive(currentDir); err != nil {
+			if err == errWatchFallback {
+				w.Close()
+				return err
+			}
 
 			errorMessage = "Failed to add directory to recursive file watching list: " + currentDir
 			ControllerWarning.log(errorMessage, err)
@@ -452,20 +762,39 @@ func runWatcher(fileChangeCommand string, dirs []string, killServer bool, intera
 	// Start the watching process - it'll check for changes every "n" ms.
 
 	go func() {
+		// with a debounce period events are collected until no event has arrived for the period,
+		// then the ON_CHANGE action runs once for all of them
+		var pendingEvents []watcher.Event
+		var quiet <-chan time.Time
 		for {
 			select {
-			case event := <-w.Event:
+			case event := <-w.Events():
 				ControllerDebug.log("File watch event detected for:  " + event.String())
+				publishEvent(controllerEvent{Type: eventWatch, Op: event.Op.String(), Path: event.Path})
+				recordFileEvent(event.Op.String())
+
+				if appsodyWATCHDEBOUNCE > 0 {
+					pendingEvents = append(pendingEvents, event)
+					quiet = time.After(appsodyWATCHDEBOUNCE)
+					continue
+				}
 
 				ControllerDebug.log("About to perform the ON_CHANGE action.")
 
-				if fileChangeCommand != "" {
-					go runCommands(fileChangeCommand, fileWatcher, killServer, false, interactive)
-				}
+				go onFileChanges(fileChangeCommand, killServer, interactive, []watcher.Event{event})
+
+			case <-quiet:
+				ControllerDebug.log("No file events for ", appsodyWATCHDEBOUNCE, ", about to perform the ON_CHANGE action for ", len(pendingEvents), " file events.")
+				changedFiles := pendingEvents
+				pendingEvents = nil
+				quiet = nil
 
-			case err := <-w.Error:
+				go onFileChanges(fileChangeCommand, killServer, interactive, changedFiles)
+
+			case err := <-w.Errors():
 				ControllerWarning.log("An error occured in the file watcher ", err)
-			case <-w.Closed:
+				publishEvent(controllerEvent{Type: eventWatcherError, Message: err.Error()})
+			case <-w.Closed():
 				ControllerDebug.log("The file watcher is now closed")
 				return
 			}
@@ -473,26 +802,28 @@ func runWatcher(fileChangeCommand string, dirs []string, killServer bool, intera
 	}()
 
 	ControllerDebug.log("The watch interval is set to: ", appsodyWATCHINTERVAL, " seconds.")
-	if err = w.Start(appsodyWATCHINTERVAL); err != nil {
+	if err = w.Start(appsodyWATCHINTERVAL); err != nil && err != errWatchFallback {
 		errorMessage = "Could not start the watcher "
 		ControllerError.log(errorMessage+" ", err)
 	}
-	defer w.Close()
 	// Close the watcher at function end
-	//defer w.Close()
+	w.Close()
 
 	return err
 }
 
 /*
    determine if we need to kill the server process
+   changedFiles are the file events which caused an ON_CHANGE action, they are passed to the ON_CHANGE command
 
 */
-func runCommands(commandString string, theProcessType ProcessType, killServer bool, noWatcher bool, interactive bool) {
+func runCommands(commandString string, theProcessType ProcessType, killServer bool, noWatcher bool, interactive bool, changedFiles []watcher.Event) {
 
 	var cmd *exec.Cmd
 	var err error
 	var mutexUnlocked bool
+	var shuttingDown bool
+	var exitedOnItsOwn bool
 
 	// Start a new watch action
 	ControllerDebug.log("Running command:  "+commandString, " for process type ", processTypeToString(theProcessType))
@@ -503,61 +834,152 @@ func runCommands(commandString string, theProcessType ProcessType, killServer bo
 
 	if theProcessType == server {
 
-		// keep going
-		cmd, err = startProcess(commandString, server, interactive)
-		ControllerDebug.log("Started RUN/DEBUG/TEST process")
-		if err != nil {
-			ControllerWarning.log("ERROR start server (APPSODY_RUN/DEBUG/TEST) received error ", err)
+		restarts := newRestartTracker(restartPolicy)
+		for {
+			// the server being restarted or replaced must be gone before the new one starts
+			waitForStops()
+			if cmps.shuttingDown {
+				cmps.mu.Unlock()
+				shuttingDown = true
+				break
+			}
+			// keep going
+			nextRestartCycle()
+			cmd, err = startProcess(commandString, server, interactive, nil)
+			ControllerDebug.log("Started RUN/DEBUG/TEST process")
+			if cmps.serverRestarting {
+				cmps.serverRestarting = false
+				onChangeApplied()
+			}
+			if err != nil {
+				ControllerWarning.log("ERROR start server (APPSODY_RUN/DEBUG/TEST) received error ", err)
+			} else if appsodyREADINESSPROBE == nil {
+				// with a readiness probe the hook runs once the server is ready
+				startHook(hookPostStart, serverPidEnv(cmd.Process.Pid))
+			}
+			started := time.Now()
+			cmps.mu.Unlock()
+
+			err = waitProcess(cmd, theProcessType)
+
+			// a restart requested through the control API kills the server, start it again rather than treating this as an exit
+			cmps.mu.Lock()
+			shuttingDown = cmps.shuttingDown
+			if reason := cmps.restartRequested; reason != "" {
+				cmps.restartRequested = ""
+				ControllerInfo.log("Restarting the APPSODY_RUN/DEBUG/TEST process ", describeRestartReason(reason), ".")
+				metricServerRestarts.inc(reason)
+				continue
+			}
+			// detachProcess clears the pid, so the pid is only unchanged if the server exited on its own
+			exitedOnItsOwn = !shuttingDown && cmps.pids[server] == cmd.Process.Pid
+			cmps.mu.Unlock()
+			if !exitedOnItsOwn {
+				break
+			}
+			if err != nil {
+				_ = runHook(hookOnFailure, failureHookEnv(cmd.Process.Pid, err))
+			}
+
+			backoff, restart := restarts.next(exitCodeFromError(err), time.Since(started))
+			if !restart {
+				break
+			}
+			ControllerWarning.logProcess(server, cmd.Process.Pid, "The APPSODY_RUN/DEBUG/TEST process exited with ", err, ", restarting it in ", backoff, " (restart policy ", restartPolicy, ")")
+			publishProcessEvent(eventServerRestart, server, cmd.Process.Pid)
+			metricServerRestarts.inc(restartReasonExited)
+			time.Sleep(backoff)
+
+			cmps.mu.Lock()
+			if cmps.shuttingDown || cmps.pids[server] != cmd.Process.Pid || (stopWatchServerOnChange && cmps.pids[fileWatcher] != 0) {
+				// a restart through the control API or an ON_CHANGE action has replaced the server in the meantime
+				cmps.mu.Unlock()
+				ControllerDebug.log("The APPSODY_RUN/DEBUG/TEST process has been replaced, the automatic restart is cancelled.")
+				exitedOnItsOwn = false
+				break
+			}
 		}
-		cmps.mu.Unlock()
 		mutexUnlocked = true
 
-		err = waitProcess(cmd, theProcessType)
-		if noWatcher {
+		if noWatcher && shuttingDown {
+			// the controller is shutting down and will exit once the managed processes are stopped
+			ControllerDebug.log("The APPSODY_RUN/DEBUG/TEST process was stopped by the controller shutdown.")
+			// returning would end main before the rest of the process group has been stopped
+			select {}
+		} else if noWatcher {
 			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
+				if _, ok := err.(*exec.ExitError); ok {
 
-					statusCode := exitErr.ExitCode()
-					ControllerError.log("Wait received error with status code: " + strconv.Itoa(statusCode) + " due to error: " + err.Error())
-					reapChildProcesses(5)
+					statusCode := exitStatus(err)
+					ControllerError.logProcess(server, cmd.Process.Pid, "Wait received error with status code: "+strconv.Itoa(statusCode)+" due to error: "+err.Error())
+					reapOrphans()
 					os.Exit(statusCode)
 					// The program has exited with an exit code != 0
 
 				} else {
 					ControllerError.log("Could not determine exit code for error: ", err)
 					// run the reaper to clean up anything
-					reapChildProcesses(5)
+					reapOrphans()
 					os.Exit(1)
 				}
 			}
-			reapChildProcesses(5)
+			reapOrphans()
 		} else {
 			if err != nil {
-				ControllerInfo.log("Wait received error on APPSODY_RUN/DEBUG/TEST ", err)
+				ControllerInfo.logProcess(server, cmd.Process.Pid, "Wait received error on APPSODY_RUN/DEBUG/TEST ", err)
+			}
+			if exitedOnItsOwn && exitOnServerExit {
+				exitWithServer(server, cmd.Process.Pid, err)
 			}
 		}
 	} else {
+		if prepRunning {
+			ControllerDebug.log("APPSODY_PREP is running, the ON_CHANGE action is skipped as the APPSODY_RUN/DEBUG/TEST process is started once APPSODY_PREP succeeds.")
+			cmps.mu.Unlock()
+			return
+		}
+		// a newer ON_CHANGE action replaces this one while the processes it replaces are stopped
+		onChangeGeneration++
+		generation := onChangeGeneration
+		nextRestartCycle()
 		ControllerDebug.log("Inside the ON_CHANGE path")
+		publishEvent(controllerEvent{Type: eventOnChangeStarted, ProcessType: eventProcessTypes[fileWatcher]})
+		if changedFiles != nil {
+			metricOnChangeRuns.inc("files")
+		} else {
+			metricOnChangeRuns.inc("api")
+		}
+		// with a build command the server is only killed once the build has succeeded
+		if buildCommand != "" && !runBuild(changedFiles, interactive, generation) {
+			cmps.mu.Unlock()
+			return
+		}
+		if reloadSignal != 0 {
+			ControllerDebug.log("APPSODY_RUN/DEBUG/TEST_RELOAD_SIGNAL is set, reloading the APPSODY_RUN/DEBUG/TEST process in place of restarting it.")
+			reloadServer(commandString, interactive, changedFiles, generation)
+			return
+		}
 		// This is a watcher
+		var stopping []*stoppingProcess
 		if killServer {
 			ControllerDebug.log("APPSODY_RUN/DEBUG/TEST_ON_KILL is true, attempting to kill the corresponding process.")
-			err = killProcess(server, 0)
-			if err != nil {
-				// do nothing we continue after kill errors
-				ControllerWarning.log("The attempt to kill the process received an error ", err)
+			if cmps.pids[server] != 0 {
+				metricServerRestarts.inc(restartReasonOnChange)
 			}
+			stopping = append(stopping, detachProcess(server))
 		}
 		ControllerDebug.log("Killing the APPSODY_RUN/DEBUG/TEST_ON_CHANGE process.")
-
-		err = killProcess(fileWatcher, 0)
-		if err != nil {
-			// do nothing we continue after kill errors
-			ControllerWarning.log("Killing the the APPSODY_RUN/DEBUG/TEST_ON_CHANGE process received error ", err)
+		stopping = append(stopping, detachProcess(fileWatcher))
+		stopDetached(stopping...)
+		if onChangeReplaced(generation) {
+			ControllerDebug.log("A newer ON_CHANGE action or the controller shutdown has replaced this ON_CHANGE action.")
+			cmps.mu.Unlock()
+			return
 		}
-		go reapChildProcesses(5)
 
 		commandToUse := commandString
 		processTypeToUse := fileWatcher
+		var env []string
 
 		if !killServer {
 			// this path is only relevant for APPSODY_<RUN/DEBUG/TEST>KILL_SERVER=FALSE
@@ -570,23 +992,61 @@ func runCommands(commandString string, theProcessType ProcessType, killServer bo
 				processTypeToUse = server
 			}
 		}
+		if processTypeToUse == fileWatcher {
+			env = changedFilesEnv(changedFiles)
+		}
 		ControllerDebug.log("Starting process of type ", processTypeToString(processTypeToUse), " running command: ", commandToUse)
 
-		cmd, err = startProcess(commandToUse, processTypeToUse, interactive)
+		cmd, err = startProcess(commandToUse, processTypeToUse, interactive, env)
 
 		if err != nil {
 			ControllerWarning.log("Received and error starting process of type ", processTypeToString(processTypeToUse), " running command: ", commandToUse, " error received was: ", err)
 
 		}
+		// the change is ready once the process replacing the server has started, or once the readiness probe passes
+		// when it is the server, an ON_CHANGE command run alongside the server is ready when it succeeds
+		if killServer || (processTypeToUse == server && appsodyREADINESSPROBE == nil) {
+			recordChangeReady()
+		}
+		if err == nil && killServer {
+			startHook(hookPostChange, changedFilesEnv(changedFiles))
+		} else if err == nil && processTypeToUse == server && appsodyREADINESSPROBE == nil {
+			startHook(hookPostStart, serverPidEnv(cmd.Process.Pid))
+		}
+		if killServer || processTypeToUse == server {
+			// the process takes the place of the server and keeps running, the change has been applied
+			onChangeApplied()
+		}
 		cmps.mu.Unlock()
 		mutexUnlocked = true
 
 		err = waitProcess(cmd, processTypeToUse)
+		removeChangedFilesManifest(env)
+		if processTypeToUse == fileWatcher && !killServer {
+			if err == nil {
+				recordChangeReady()
+				startHook(hookPostChange, changedFilesEnv(changedFiles))
+			} else {
+				cancelPendingChange()
+			}
+		}
 		if err != nil {
 			// do nothing as the kill causees and error condition
-			ControllerWarning.log("Wait Received error starting process of type ", processTypeToString(processTypeToUse), " while running command: ", commandToUse, " error received was: ", err)
+			ControllerWarning.logProcess(processTypeToUse, cmd.Process.Pid, "Wait Received error starting process of type ", processTypeToString(processTypeToUse), " while running command: ", commandToUse, " error received was: ", err)
 
 		}
+		// the ON_CHANGE process takes the place of the server when APPSODY_RUN/DEBUG/TEST_KILL is true
+		if killServer || processTypeToUse == server {
+			cmps.mu.RLock()
+			exitedOnItsOwn = !cmps.shuttingDown && cmps.pids[processTypeToUse] == cmd.Process.Pid
+			cmps.mu.RUnlock()
+			if exitedOnItsOwn && err != nil {
+				_ = runHook(hookOnFailure, failureHookEnv(cmd.Process.Pid, err))
+			}
+			if exitedOnItsOwn && exitOnServerExit {
+				exitWithServer(processTypeToUse, cmd.Process.Pid, err)
+			}
+		}
 
 	}
 
@@ -598,19 +1058,27 @@ func runCommands(commandString string, theProcessType ProcessType, killServer bo
 }
 
 var startCommand string
+var fileChangeCommand string
+var buildCommand string
+var watchDirsSource string
+var stopWatchServerOnChange bool
+var restartPolicy string
+var stopSignal = defaultStopSignal
+var stopTimeout = defaultStopTimeout
+var reloadSignal syscall.Signal
+var exitOnServerExit bool
+var controllerMode string
+var controllerStartTime time.Time
 
 func main() {
 
 	var err error
-	var fileChangeCommand string
 	debugMode := false
 	testMode := false
 	var dirs []string
-	var stopWatchServerOnChange bool
 
 	errorMessage := ""
 	var errWorkDir error
-	var disableWatcher bool
 
 	mode := flag.String("mode", "run", "This is the mode the controller runs in: run, debug or test")
 	flag.BoolVar(&verbose, "verbose", false, "Turns on debug output and logging ")
@@ -618,8 +1086,15 @@ func main() {
 	flag.BoolVar(&disableWatcher, "no-watcher", false, "Disable file watching regardless of environment variables.")
 	flag.BoolVar(&version, "version", false, "Prints the controller version and exits")
 	flag.BoolVar(&interactiveFlag, "interactive", false, "Controller runs in interactive mode")
+	flag.BoolVar(&checkConfig, "check", false, "Prints the effective configuration and exits, with a non zero exit code if the configuration is invalid")
+	flag.BoolVar(&checkConfig, "print-config", false, "The same as --check")
+	flag.BoolVar(&forcePrep, "force-prep", false, "Runs APPSODY_PREP even if its APPSODY_PREP_CACHE_INPUTS are unchanged since it last succeeded")
+	checkFormat := flag.String("format", "text", "The format of the --check output: text or json")
+	configFlag := flag.String("config", "", "The YAML or JSON controller configuration file, defaults to .appsody-controller.yaml, .yml or .json in the working dir")
+	flag.StringVar(&logFormat, "log-format", logFormatText, "The format of the controller log: text or json")
 
 	flag.Parse()
+	controllerMode = *mode
 
 	klogFlags = flag.NewFlagSet("klog", flag.ExitOnError)
 	klog.InitFlags(klogFlags)
@@ -634,12 +1109,20 @@ func main() {
 
 	}
 	_ = klogFlags.Set("skip_headers", "true")
+	if logFormat != logFormatText && logFormat != logFormatJSON {
+		invalidFormat := logFormat
+		logFormat = logFormatText
+		ControllerFatal.log("Fatal: Invalid --log-format, use text or json: ", invalidFormat)
+		os.Exit(exitCodeInvalidConfig)
+	}
 
 	if disableWatcher {
 		ControllerInfo.log("File watching has been turned off at the request of the CLI.")
 	}
 
 	ControllerDebug.log("Running Appsody Controller version " + VERSION)
+	controllerStartTime = time.Now()
+	appsodyControllerManagedProcesses()
 
 	if strings.Compare(*mode, "test") == 0 {
 		testMode = true
@@ -656,105 +1139,74 @@ func main() {
 		ControllerFatal.log("Could not find the working dir ", errWorkDir)
 		os.Exit(1)
 	}
+	// The configuration file sets the environment variables which are not already set
+	configFileErr := loadConfigFile(*configFlag)
+	if configFileErr != nil && !checkConfig {
+		ControllerFatal.log("Fatal: Appsody Controller could not load the configuration file: ", configFileErr)
+		os.Exit(exitCodeInvalidConfig)
+	}
 	// Obtain the environment variables
 	err = setupEnvironmentVars()
-	if err != nil {
-		errorMessage = "Fatal: Appsody Controller setup did not find all environment variables "
+	if err != nil && !checkConfig {
+		errorMessage = "Fatal: Appsody Controller setup failed, "
 		ControllerFatal.log(errorMessage, err)
-		os.Exit(1)
+		os.Exit(exitCodeInvalidConfig)
 	}
 
-	// Set the startCommand based upon whether debug Mode is enabled
-	if debugMode {
-		startCommand = appsodyDEBUG
-	} else if testMode {
-		startCommand = appsodyTEST
-	} else {
-		startCommand = appsodyRUN
-	}
-	if startCommand == "" {
-		ControllerWarning.log("Warning: the APPSODY_DEBUG,APPSODY_TEST or APPSODY_RUN command is unspecified")
-	}
-	ControllerDebug.log("APPSODY_DEBUG,APPSODY_TEST or APPSODY_RUN command : " + startCommand)
-	if debugMode {
-		//note this could be ""
-		fileChangeCommand = appsodyDEBUGWATCHACTION
-	} else if testMode {
-		fileChangeCommand = appsodyTESTWATCHACTION
-	} else {
-		fileChangeCommand = appsodyRUNWATCHACTION
-	}
-	ControllerDebug.log("File change command: " + fileChangeCommand)
-
-	// use the appropriate server on change setting
-	if debugMode {
-
-		stopWatchServerOnChange = appsodyDEBUGKILL
-	} else if testMode {
-		stopWatchServerOnChange = appsodyTESTKILL
-	} else {
-		stopWatchServerOnChange = appsodyRUNKILL
-	}
+	dirs = selectModeSettings(debugMode, testMode)
 
-	// Prefer the watch dirs be set to the APPSODY_WATCH_DIR value, but fall back to the APPSODY_MOUNTS if need be
-
-	if appsodyWATCHDIRS != nil {
-		dirs = appsodyWATCHDIRS
-	} else {
-		dirs = appsodyMOUNTS
+	if checkConfig {
+		os.Exit(printConfigCheck(*checkFormat, dirs, combineConfigErrors(configFileErr, err)))
 	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	if !forwardsSignal(syscall.SIGQUIT) {
+		signal.Notify(c, syscall.SIGQUIT)
+	}
 	go func() {
-		<-c
+		sig := <-c
 		ControllerDebug.log("Inside signal handler for controller")
-		ControllerDebug.log("Killing the ON_CHANGE process")
-		// In practice either the fileWatcher or server process will be alive, not both
-		err := killProcess(fileWatcher, 2) // we give 2 *2 seconds to kill the filewatcher/ON_CHANGE process
-		if err != nil {
-			ControllerError.log("Received error during signal handler killing ON_CHANGE process", err)
-		}
-		ControllerDebug.log("Killing the server process")
-		err = killProcess(server, 2) // we give 2 *2 seconds to kill the server process
-		if err != nil {
-			ControllerError.log("Received error during signal handler killing the RUN/TEST/DEBUG process", err)
-		}
-		// 5 * .2 second waiting for reaping of child processes
-
-		reapChildProcesses(5)
-		os.Exit(0)
-		ControllerDebug.log("Done processing controller signal handler.")
+		shutdownController(sig.(syscall.Signal))
 	}()
+	startReaper()
+	startSignalForwarding()
+
+	startControlServer()
+	startMetricsServer()
 
 	if appsodyPREP != "" {
 		ControllerDebug.log("Running APPSODY_PREP command: ", appsodyPREP)
 
-		_, err = runPrep(appsodyPREP, interactiveFlag)
+		err = runPrepCached(interactiveFlag)
+		if err == errPrepCancelled {
+			// the controller is shutting down
+			select {}
+		}
 	}
 	if err != nil {
 		ControllerError.log("FATAL error APPSODY_PREP command received an error.  The controller is exiting: ", err)
 		os.Exit(1)
 	}
 
-	if fileChangeCommand == "" || disableWatcher {
+	if !fileWatchingConfigured() || disableWatcher {
 		ControllerDebug.log("The fileChangeCommand environment variable APPSODY_RUN/DEBUG/TEST_ON_CHANGE is unspecified or file watching was disabled by the CLI.")
 		ControllerDebug.log("Running APPSODY_RUN,APPSODY_DEBUG or APPSODY_TEST sync: " + startCommand)
-		runCommands(startCommand, server, false, true, interactiveFlag)
+		runCommands(startCommand, server, false, true, interactiveFlag, nil)
 
 	} else {
 		ControllerDebug.log("Running APPSODY_RUN,APPSODY_DEBUG or APPSODY_TEST async: " + startCommand)
 
-		go runCommands(startCommand, server, false, false, interactiveFlag)
+		go runCommands(startCommand, server, false, false, interactiveFlag, nil)
 
 	}
 
-	if fileChangeCommand != "" && !disableWatcher {
+	if fileWatchingConfigured() && !disableWatcher {
 
 		err = runWatcher(fileChangeCommand, dirs, stopWatchServerOnChange, interactiveFlag)
 	} else {
 
-		ControllerInfo.log("The file watcher is not running because no APPSODY_RUN/TEST/DEBUG_ON_CHANGE action was specified or it has been disabled using the --no-watcher flag.")
+		ControllerInfo.log("The file watcher is not running because no APPSODY_RUN/TEST/DEBUG_ON_CHANGE action or RELOAD_SIGNAL was specified or it has been disabled using the --no-watcher flag.")
 	}
 	if err != nil {
 		errorMessage = "Error running the file watcher: "
@@ -764,42 +1216,117 @@ func main() {
 
 }
 
-func reapChildProcesses(maxLimit int) {
-	countLimit := 0
+// selectModeSettings selects the commands and settings for the controller mode, it returns the directories to watch
+func selectModeSettings(debugMode bool, testMode bool) []string {
+	// Set the startCommand based upon whether debug Mode is enabled
+	if debugMode {
+		startCommand = appsodyDEBUG
+	} else if testMode {
+		startCommand = appsodyTEST
+	} else {
+		startCommand = appsodyRUN
+	}
+	if startCommand == "" {
+		ControllerWarning.log("Warning: the APPSODY_DEBUG,APPSODY_TEST or APPSODY_RUN command is unspecified")
+	}
+	ControllerDebug.log("APPSODY_DEBUG,APPSODY_TEST or APPSODY_RUN command : " + startCommand)
+	if debugMode {
+		//note this could be ""
+		fileChangeCommand = appsodyDEBUGWATCHACTION
+	} else if testMode {
+		fileChangeCommand = appsodyTESTWATCHACTION
+	} else {
+		fileChangeCommand = appsodyRUNWATCHACTION
+	}
+	ControllerDebug.log("File change command: " + fileChangeCommand)
+	if debugMode {
+		buildCommand = appsodyDEBUGBUILD
+	} else if testMode {
+		buildCommand = appsodyTESTBUILD
+	} else {
+		buildCommand = appsodyRUNBUILD
+	}
 
-	for {
+	// use the appropriate server on change setting
+	if debugMode {
 
-		var wstatus syscall.WaitStatus
-		//WNOHANG means return if there are no child processes to wait for
-		//This command will wait for processes that hae been reassigned
-		// to pid 1 after the server or fileWatcher/ON_CHANGE process is terminated
-		pid, err := syscall.Wait4(-1, &wstatus, syscall.WNOHANG, nil)
-		ControllerDebug.log("Reaper pid/err is: ", pid, err)
-		// If it is 0 that means no process was waiting atm, we will sleep and give a little more time
-		if pid == 0 && countLimit < maxLimit && err == nil {
-			ControllerDebug.log("Reaper sleeping 200 millisecond: ", pid)
-			time.Sleep(200 * time.Millisecond)
-			countLimit++
-		}
-
-		if syscall.EINTR == err {
-			// A Signal Interupt occured and we should stop processing
-			ControllerDebug.log("Signal Interrupt: ", err)
-			break
-		}
-		//This value means no child processes left waiting.
-		if syscall.ECHILD == err {
-			ControllerDebug.log("No more child processes: ", err)
-			break
-		}
+		stopWatchServerOnChange = appsodyDEBUGKILL
+	} else if testMode {
+		stopWatchServerOnChange = appsodyTESTKILL
+	} else {
+		stopWatchServerOnChange = appsodyRUNKILL
+	}
+
+	// use the appropriate restart policy for a server which exits on its own
+	if debugMode {
+		restartPolicy = appsodyDEBUGRESTART
+		exitOnServerExit = appsodyDEBUGEXITONSERVEREXIT
+	} else if testMode {
+		restartPolicy = appsodyTESTRESTART
+		exitOnServerExit = appsodyTESTEXITONSERVEREXIT
+	} else {
+		restartPolicy = appsodyRUNRESTART
+		exitOnServerExit = appsodyRUNEXITONSERVEREXIT
+	}
 
-		ControllerDebug.log("Max limit count: ", countLimit)
+	// use the appropriate signal and grace period to stop the processes
+	if debugMode {
+		stopSignal = appsodyDEBUGSTOPSIGNAL
+		stopTimeout = appsodyDEBUGSTOPTIMEOUT
+	} else if testMode {
+		stopSignal = appsodyTESTSTOPSIGNAL
+		stopTimeout = appsodyTESTSTOPTIMEOUT
+	} else {
+		stopSignal = appsodyRUNSTOPSIGNAL
+		stopTimeout = appsodyRUNSTOPTIMEOUT
+	}
+	reloadSignal = modeReloadSignal(controllerMode)
+	hooks = modeHooks(controllerMode)
 
-		if countLimit >= maxLimit {
-			ControllerDebug.log("Max limit reached: ", maxLimit)
-			break
-		}
+	// Prefer the watch dirs be set to the APPSODY_WATCH_DIR value, but fall back to the APPSODY_MOUNTS if need be
 
+	if appsodyWATCHDIRS != nil {
+		watchDirsSource = "APPSODY_WATCH_DIR"
+		return appsodyWATCHDIRS
 	}
+	watchDirsSource = "APPSODY_MOUNTS"
+	return appsodyMOUNTS
+}
 
+// stopControllerManagedProcesses kills the ON_CHANGE and server processes prior to the controller exiting,
+// it is called by the signal handler, the control API and exitWithServer, only the first call stops the processes
+func stopControllerManagedProcesses() {
+	shutdownOnce.Do(func() {
+		stopControlServer()
+		cmps.mu.Lock()
+		cmps.shuttingDown = true
+		cmps.restartRequested = ""
+		// In practice either the fileWatcher or server process will be alive, not both
+		onChange := detachProcess(fileWatcher)
+		building := detachProcess(build)
+		preparing := detachProcess(prep)
+		serving := detachProcess(server)
+		cmps.mu.Unlock()
+		ControllerDebug.log("Killing the ON_CHANGE process")
+		err := onChange.stop()
+		if err != nil {
+			ControllerError.log("Received error during shutdown killing ON_CHANGE process", err)
+		}
+		err = building.stop()
+		if err != nil {
+			ControllerError.log("Received error during shutdown killing the BUILD process", err)
+		}
+		err = preparing.stop()
+		if err != nil {
+			ControllerError.log("Received error during shutdown killing the PREP process", err)
+		}
+		ControllerDebug.log("Killing the server process")
+		err = serving.stop()
+		if err != nil {
+			ControllerError.log("Received error during shutdown killing the RUN/TEST/DEBUG process", err)
+		}
+		reapOrphans()
+		removeChangedFilesDir()
+		ControllerDebug.log("Done stopping the controller managed processes.")
+	})
 }
@@ -0,0 +1,272 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons for the server restarts counted by the metrics
+const (
+	restartReasonExited    = "exited"
+	restartReasonRequested = "requested"
+	restartReasonOnChange  = "on-change"
+	restartReasonPrep      = "prep"
+	restartReasonLiveness  = "liveness"
+)
+
+// metricCounter is a Prometheus counter, with one value for each set of label values
+type metricCounter struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+// metricHistogram is a Prometheus histogram of durations in seconds, with one series for each set of label values
+type metricHistogram struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newCounter(name string, help string, labelNames ...string) *metricCounter {
+	return &metricCounter{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+}
+
+func newHistogram(name string, help string, buckets []float64, labelNames ...string) *metricHistogram {
+	return &metricHistogram{name: name, help: help, labelNames: labelNames, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the labels in the exposition format without the braces, for instance process_type="server"
+func formatLabels(names []string, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelValueEscaper.Replace(value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// withLabels returns the metric name followed by the labels in braces, if there are any
+func withLabels(name string, labels ...string) string {
+	var nonEmpty []string
+	for _, label := range labels {
+		if label != "" {
+			nonEmpty = append(nonEmpty, label)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *metricCounter) inc(labelValues ...string) {
+	labels := formatLabels(c.labelNames, labelValues)
+	c.mu.Lock()
+	c.values[labels]++
+	c.mu.Unlock()
+}
+
+func (c *metricCounter) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labelNames) == 0 {
+		fmt.Fprintf(buf, "%v %v\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for labels := range c.values {
+		keys = append(keys, labels)
+	}
+	for _, labels := range sortedKeys(keys) {
+		fmt.Fprintf(buf, "%v %v\n", withLabels(c.name, labels), formatFloat(c.values[labels]))
+	}
+}
+
+func (h *metricHistogram) observe(d time.Duration, labelValues ...string) {
+	labels := formatLabels(h.labelNames, labelValues)
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series := h.series[labels]
+	if series == nil {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = series
+	}
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+func (h *metricHistogram) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.labelNames) == 0 && h.series[""] == nil {
+		h.series[""] = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	}
+	keys := make([]string, 0, len(h.series))
+	for labels := range h.series {
+		keys = append(keys, labels)
+	}
+	for _, labels := range sortedKeys(keys) {
+		series := h.series[labels]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(buf, "%v %v\n", withLabels(h.name+"_bucket", labels, `le="`+formatFloat(bound)+`"`), series.counts[i])
+		}
+		fmt.Fprintf(buf, "%v %v\n", withLabels(h.name+"_bucket", labels, `le="+Inf"`), series.count)
+		fmt.Fprintf(buf, "%v %v\n", withLabels(h.name+"_sum", labels), formatFloat(series.sum))
+		fmt.Fprintf(buf, "%v %v\n", withLabels(h.name+"_count", labels), series.count)
+	}
+}
+
+var (
+	metricFileEvents = newCounter("appsody_controller_file_events_total",
+		"File events seen by the file watcher.", "op")
+	metricOnChangeRuns = newCounter("appsody_controller_on_change_runs_total",
+		"ON_CHANGE actions run, triggered by file changes or the control API.", "trigger")
+	metricOnChangeHeld = newCounter("appsody_controller_on_change_held_total",
+		"ON_CHANGE actions requested while an action was running, by APPSODY_ON_CHANGE_POLICY outcome.", "outcome")
+	metricServerRestarts = newCounter("appsody_controller_server_restarts_total",
+		"Restarts of the APPSODY_RUN/DEBUG/TEST process.", "reason")
+	metricProcessExits = newCounter("appsody_controller_process_exits_total",
+		"Exits of the controller managed processes by exit code, -1 when the process was ended by a signal.", "process_type", "exit_code")
+	metricPrepDuration = newHistogram("appsody_controller_prep_duration_seconds",
+		"How long the APPSODY_PREP command took.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600})
+	metricKillDuration = newHistogram("appsody_controller_kill_duration_seconds",
+		"How long stopping a controller managed process took.", []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "process_type")
+	metricChangeToReady = newHistogram("appsody_controller_change_to_ready_seconds",
+		"Time from the first file change of an ON_CHANGE action until the server is ready again.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120})
+)
+
+// the time of the first file change which has not yet been followed by a ready server, protected by pendingChangeMu
+var (
+	pendingChange   time.Time
+	pendingChangeMu sync.Mutex
+)
+
+// recordFileEvent counts a file event, the first event after the server was last ready starts the change-to-ready timer
+func recordFileEvent(op string) {
+	metricFileEvents.inc(op)
+	pendingChangeMu.Lock()
+	if pendingChange.IsZero() {
+		pendingChange = time.Now()
+	}
+	pendingChangeMu.Unlock()
+}
+
+// recordChangeReady records the change-to-ready latency if there is a file change waiting for the server
+func recordChangeReady() {
+	pendingChangeMu.Lock()
+	defer pendingChangeMu.Unlock()
+	if !pendingChange.IsZero() {
+		metricChangeToReady.observe(time.Since(pendingChange))
+		pendingChange = time.Time{}
+	}
+}
+
+// cancelPendingChange stops the change-to-ready timer when the change will not lead to a new server
+func cancelPendingChange() {
+	pendingChangeMu.Lock()
+	pendingChange = time.Time{}
+	pendingChangeMu.Unlock()
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodGet) {
+		return
+	}
+	var buf bytes.Buffer
+	metricFileEvents.write(&buf)
+	metricOnChangeRuns.write(&buf)
+	metricOnChangeHeld.write(&buf)
+	metricServerRestarts.write(&buf)
+	metricProcessExits.write(&buf)
+	metricPrepDuration.write(&buf)
+	metricKillDuration.write(&buf)
+	metricChangeToReady.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// validateMetricsAddress checks an APPSODY_METRICS_ADDRESS value such as :9090 or 127.0.0.1:9090
+func validateMetricsAddress(envVar string, value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(value); err != nil || port == "" {
+		return configError{envVar, value, "The metrics address must be a host and port such as :9090"}
+	}
+	return nil
+}
+
+// startMetricsServer serves /metrics over TCP for Prometheus when APPSODY_METRICS_ADDRESS is set,
+// the metrics are always available from the control API
+func startMetricsServer() {
+	if appsodyMETRICSADDRESS == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", appsodyMETRICSADDRESS)
+	if err != nil {
+		ControllerWarning.log("Could not start the metrics endpoint on ", appsodyMETRICSADDRESS, " ", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	ControllerInfo.log("Serving the controller metrics on http://", listener.Addr(), "/metrics")
+	go func() {
+		err := http.Serve(listener, mux)
+		ControllerDebug.log("The metrics endpoint has stopped: ", err)
+	}()
+}
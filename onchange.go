@@ -0,0 +1,164 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/appsody/watcher"
+)
+
+// Values for APPSODY_ON_CHANGE_POLICY, how a change is handled while an ON_CHANGE action is running
+const (
+	onChangePolicyCancel = "cancel-and-restart"
+	onChangePolicyQueue  = "queue-one"
+	onChangePolicyIgnore = "ignore-while-running"
+)
+
+// the number of queued ON_CHANGE actions when APPSODY_ON_CHANGE_MAX_QUEUE is not set
+const defaultOnChangeMaxQueue = 1
+
+// onChangeScheduler runs one ON_CHANGE action at a time for the queue-one and ignore-while-running policies.
+// An action is running from the time it starts until it has been applied: the ON_CHANGE command has finished,
+// or the process replacing the server has started, or the server has been reloaded.
+type onChangeScheduler struct {
+	// mu protects the following.
+	mu      sync.Mutex
+	running bool
+	applied chan struct{}
+	queue   [][]watcher.Event
+}
+
+var onChanges onChangeScheduler
+
+// the number of the latest ON_CHANGE action, protected by cmps.mu
+var onChangeGeneration int
+
+// onChangeReplaced returns true if a newer ON_CHANGE action has started or the controller is shutting down,
+// it is called with cmps.mu locked
+func onChangeReplaced(generation int) bool {
+	return cmps.shuttingDown || onChangeGeneration != generation
+}
+
+// computeOnChangePolicy parses an APPSODY_ON_CHANGE_POLICY value, which defaults to cancel-and-restart
+func computeOnChangePolicy(envVar string, value string) (string, error) {
+	policy := strings.ToLower(strings.TrimSpace(value))
+	switch policy {
+	case onChangePolicyCancel, onChangePolicyQueue, onChangePolicyIgnore:
+		return policy, nil
+	case "":
+		return onChangePolicyCancel, nil
+	}
+	return onChangePolicyCancel, configError{envVar, value, "The ON_CHANGE policy must be one of cancel-and-restart, queue-one or ignore-while-running"}
+}
+
+// scheduleOnChange runs the ON_CHANGE action for the changed files, nil for a request through the control API.
+// With cancel-and-restart the action replaces any running action, otherwise the changes are queued or ignored
+// while an action is running.
+func scheduleOnChange(commandString string, killServer bool, interactive bool, changedFiles []watcher.Event) {
+	if appsodyONCHANGEPOLICY == onChangePolicyCancel {
+		runCommands(commandString, fileWatcher, killServer, false, interactive, changedFiles)
+		return
+	}
+	onChanges.mu.Lock()
+	if onChanges.running {
+		if appsodyONCHANGEPOLICY == onChangePolicyIgnore {
+			onChanges.mu.Unlock()
+			ControllerInfo.log("An ON_CHANGE action is running, ignoring ", describeChangedFiles(changedFiles),
+				" as APPSODY_ON_CHANGE_POLICY is ", appsodyONCHANGEPOLICY, ".")
+			metricOnChangeHeld.inc("ignored")
+			return
+		}
+		if len(onChanges.queue) < appsodyONCHANGEMAXQUEUE {
+			onChanges.queue = append(onChanges.queue, changedFiles)
+			metricOnChangeHeld.inc("queued")
+		} else {
+			// the queue is full, the changes are run with the last queued action
+			last := len(onChanges.queue) - 1
+			onChanges.queue[last] = append(onChanges.queue[last], changedFiles...)
+			metricOnChangeHeld.inc("merged")
+		}
+		queued := len(onChanges.queue)
+		onChanges.mu.Unlock()
+		ControllerInfo.log("An ON_CHANGE action is running, queued ", describeChangedFiles(changedFiles),
+			" to run once it has finished (", queued, " of at most ", appsodyONCHANGEMAXQUEUE, " queued actions).")
+		return
+	}
+	onChanges.running = true
+	onChanges.mu.Unlock()
+
+	for {
+		runOnChange(commandString, killServer, interactive, changedFiles)
+		onChanges.mu.Lock()
+		if len(onChanges.queue) == 0 {
+			onChanges.running = false
+			onChanges.mu.Unlock()
+			return
+		}
+		changedFiles = onChanges.queue[0]
+		onChanges.queue = onChanges.queue[1:]
+		onChanges.mu.Unlock()
+		cmps.mu.RLock()
+		shuttingDown := cmps.shuttingDown
+		cmps.mu.RUnlock()
+		if shuttingDown {
+			return
+		}
+		ControllerInfo.log("Running the queued ON_CHANGE action for ", describeChangedFiles(changedFiles))
+	}
+}
+
+// runOnChange runs an ON_CHANGE action and returns once it has been applied,
+// although runCommands goes on waiting for the process which replaces the server
+func runOnChange(commandString string, killServer bool, interactive bool, changedFiles []watcher.Event) {
+	applied := make(chan struct{})
+	finished := make(chan struct{})
+	onChanges.mu.Lock()
+	onChanges.applied = applied
+	onChanges.mu.Unlock()
+	go func() {
+		runCommands(commandString, fileWatcher, killServer, false, interactive, changedFiles)
+		close(finished)
+	}()
+	select {
+	case <-applied:
+	case <-finished:
+	}
+}
+
+// onChangeApplied is called by runCommands once the process which replaces the server has started,
+// the next queued ON_CHANGE action can run from then on
+func onChangeApplied() {
+	onChanges.mu.Lock()
+	if onChanges.applied != nil {
+		close(onChanges.applied)
+		onChanges.applied = nil
+	}
+	onChanges.mu.Unlock()
+}
+
+// describeChangedFiles describes the changed files for the log, a nil list is a request through the control API
+func describeChangedFiles(changedFiles []watcher.Event) string {
+	if changedFiles == nil {
+		return "the request through the control API"
+	}
+	changes := mergeChangedFiles(changedFiles)
+	paths := make([]string, len(changes))
+	for i, change := range changes {
+		paths[i] = change.Path
+	}
+	return "the changes to " + strings.Join(paths, ", ")
+}
@@ -0,0 +1,272 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Values for APPSODY_OUTPUT_COLOR
+const (
+	outputColorAuto   = "auto"
+	outputColorAlways = "always"
+	outputColorNever  = "never"
+)
+
+// the role shown in the prefix of the APPSODY_PREP output
+const prepRole = "PREP"
+
+// ANSI colours for the prefix of each role
+var outputColors = map[string]string{
+	"RUN":       "\x1b[32m",
+	"DEBUG":     "\x1b[32m",
+	"TEST":      "\x1b[32m",
+	"ON_CHANGE": "\x1b[33m",
+	"BUILD":     "\x1b[35m",
+	prepRole:    "\x1b[36m",
+}
+
+const outputColorReset = "\x1b[0m"
+
+// the time format of the optional timestamp in the prefix
+const outputTimestampFormat = "15:04:05.000"
+
+// how long the output left in the pipes of a process is copied once it has exited
+const outputDrainTimeout = 200 * time.Millisecond
+
+// outputMu keeps the lines written by the processes from being interleaved
+var outputMu sync.Mutex
+
+// computeOutputColor parses an APPSODY_OUTPUT_COLOR value, which defaults to auto
+func computeOutputColor(envVar string, value string) (string, error) {
+	color := strings.ToLower(strings.TrimSpace(value))
+	switch color {
+	case outputColorAuto, outputColorAlways, outputColorNever:
+		return color, nil
+	case "":
+		return outputColorAuto, nil
+	}
+	return outputColorAuto, configError{envVar, value, "The output color must be one of auto, always or never"}
+}
+
+// outputRole returns the role shown in the prefix of the output of a controller managed process
+func outputRole(theProcessType ProcessType) string {
+	switch theProcessType {
+	case fileWatcher:
+		return "ON_CHANGE"
+	case build:
+		return "BUILD"
+	case prep:
+		return prepRole
+	}
+	return strings.ToUpper(controllerMode)
+}
+
+// isTerminal returns true if the file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prefixWriter writes each complete line with a prefix naming the process role and restart cycle,
+// a partial line is held back until it is completed or the process exits
+type prefixWriter struct {
+	out     *os.File
+	prefix  string
+	color   string
+	partial []byte
+}
+
+func newPrefixWriter(out *os.File, role string, cycle int64) *prefixWriter {
+	w := &prefixWriter{out: out, prefix: fmt.Sprintf("[%v #%v]", role, cycle)}
+	if colorOutput(out) {
+		w.color = outputColors[role]
+	}
+	return w
+}
+
+// colorOutput returns true if the prefixes written to the file are coloured
+func colorOutput(out *os.File) bool {
+	return appsodyOUTPUTCOLOR == outputColorAlways || (appsodyOUTPUTCOLOR == outputColorAuto && isTerminal(out))
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			break
+		}
+		if err := w.writeLine(w.partial[:end+1]); err != nil {
+			return len(p), err
+		}
+		w.partial = w.partial[end+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes out a partial line that was never completed
+func (w *prefixWriter) flush() {
+	if len(w.partial) > 0 {
+		_ = w.writeLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	var buf bytes.Buffer
+	if appsodyOUTPUTTIMESTAMP {
+		buf.WriteString(time.Now().Format(outputTimestampFormat))
+		buf.WriteByte(' ')
+	}
+	if w.color != "" {
+		buf.WriteString(w.color + w.prefix + outputColorReset)
+	} else {
+		buf.WriteString(w.prefix)
+	}
+	buf.WriteByte(' ')
+	buf.Write(line)
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := w.out.Write(buf.Bytes())
+	return err
+}
+
+// processOutput is the output of one process which is prefixed or read by the log probe.
+// The process writes to pipes created here rather than by exec.Cmd, so that waiting for the process
+// does not also wait for its descendants which keep the pipes open, such as a daemon it started.
+type processOutput struct {
+	stdout    *prefixWriter
+	stderr    *prefixWriter
+	readEnds  []*os.File
+	writeEnds []*os.File
+	copiers   sync.WaitGroup
+}
+
+// the output of the running processes, copied until they exit
+var (
+	processOutputs   = make(map[*exec.Cmd]*processOutput)
+	processOutputsMu sync.Mutex
+)
+
+// pipe sets *dst to the write end of a new pipe whose output is copied to out.
+// If the pipe can not be created, *dst is set to out and exec.Cmd copies the output instead.
+func (o *processOutput) pipe(dst *io.Writer, out io.Writer) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		ControllerWarning.log("Could not create a pipe for the process output: ", err)
+		*dst = out
+		return
+	}
+	o.readEnds = append(o.readEnds, r)
+	o.writeEnds = append(o.writeEnds, w)
+	o.copiers.Add(1)
+	go func() {
+		defer o.copiers.Done()
+		_, _ = io.Copy(out, r)
+	}()
+	*dst = w
+}
+
+// started closes the write ends of the pipes in the controller once the process has them
+func (o *processOutput) started() {
+	for _, w := range o.writeEnds {
+		_ = w.Close()
+	}
+	o.writeEnds = nil
+}
+
+// finish copies what is left in the pipes once the process has exited, then stops copying and writes out the last partial lines.
+// Descendants which still hold the pipes are only waited for outputDrainTimeout, what they write after that is not shown.
+func (o *processOutput) finish() {
+	o.started()
+	deadline := time.Now().Add(outputDrainTimeout)
+	for _, r := range o.readEnds {
+		if err := r.SetReadDeadline(deadline); err != nil {
+			_ = r.Close()
+		}
+	}
+	o.copiers.Wait()
+	for _, r := range o.readEnds {
+		_ = r.Close()
+	}
+	if o.stdout != nil {
+		o.stdout.flush()
+	}
+	if o.stderr != nil {
+		o.stderr.flush()
+	}
+}
+
+// setProcessOutput sets the stdout and stderr of the process, they are prefixed when APPSODY_OUTPUT_PREFIX is true.
+// The log probe, if there is one, also reads the stdout, so the process writes to a pipe rather than the terminal.
+// Otherwise the process writes straight to the stdout and stderr of the controller.
+func setProcessOutput(cmd *exec.Cmd, role string, logProbe io.Writer) {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if !appsodyOUTPUTPREFIX && logProbe == nil {
+		return
+	}
+	output := &processOutput{}
+	var stdout io.Writer = os.Stdout
+	if appsodyOUTPUTPREFIX {
+		cycle := atomic.LoadInt64(&restartCycle)
+		output.stdout = newPrefixWriter(os.Stdout, role, cycle)
+		output.stderr = newPrefixWriter(os.Stderr, role, cycle)
+		stdout = output.stdout
+		output.pipe(&cmd.Stderr, output.stderr)
+	}
+	if logProbe != nil {
+		stdout = io.MultiWriter(stdout, logProbe)
+	}
+	output.pipe(&cmd.Stdout, stdout)
+	processOutputsMu.Lock()
+	processOutputs[cmd] = output
+	processOutputsMu.Unlock()
+}
+
+// processOutputStarted is called once startChild has returned, the output is finished straight away if the process did not start
+func processOutputStarted(cmd *exec.Cmd, err error) {
+	if err != nil {
+		flushProcessOutput(cmd)
+		return
+	}
+	processOutputsMu.Lock()
+	output := processOutputs[cmd]
+	processOutputsMu.Unlock()
+	if output != nil {
+		output.started()
+	}
+}
+
+// flushProcessOutput copies the rest of the output of a process which has exited and writes out its last partial line
+func flushProcessOutput(cmd *exec.Cmd) {
+	processOutputsMu.Lock()
+	output := processOutputs[cmd]
+	delete(processOutputs, cmd)
+	processOutputsMu.Unlock()
+	if output != nil {
+		output.finish()
+	}
+}
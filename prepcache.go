@@ -0,0 +1,173 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the default APPSODY_PREP_CACHE_DIR, relative to the project directory so that the cache lives on the same volume
+// as the dependencies which APPSODY_PREP installs, the file watcher ignores it
+const defaultPrepCacheDir = ".appsody-cache"
+
+// the name of the file in the cache directory holding the result of the last APPSODY_PREP run
+const prepCacheFile = "prep.json"
+
+// prepCacheEntry is the result of an APPSODY_PREP run, stored in the cache directory
+type prepCacheEntry struct {
+	Hash     string    `json:"hash"`
+	Command  string    `json:"command"`
+	ExitCode int       `json:"exitCode"`
+	Time     time.Time `json:"time"`
+}
+
+// prepCacheConfigured returns true if the APPSODY_PREP inputs are hashed to skip APPSODY_PREP when they are unchanged
+func prepCacheConfigured() bool {
+	return appsodyPREP != "" && len(appsodyPREPCACHEINPUTS) > 0
+}
+
+// projectPath returns the path relative to the working directory, unless it is absolute
+func projectPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(workDir, path)
+}
+
+// prepCacheIgnoredDir returns the regular expression matching the cache directory and everything in it, nil if there is no cache.
+// The file watcher ignores the directory, as the cache is written by the controller rather than changed in the project.
+func prepCacheIgnoredDir() *regexp.Regexp {
+	if !prepCacheConfigured() {
+		return nil
+	}
+	return regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Clean(projectPath(appsodyPREPCACHEDIR))) + "(/|$)")
+}
+
+func prepCachePath() string {
+	return filepath.Join(projectPath(appsodyPREPCACHEDIR), prepCacheFile)
+}
+
+// hashPrepInputs returns the hash of the APPSODY_PREP command and the files matching the APPSODY_PREP_CACHE_INPUTS patterns,
+// the files of a directory which matches are included
+func hashPrepInputs(patterns []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", appsodyPREP)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(projectPath(pattern))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", pattern, len(matches))
+		for _, match := range matches {
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				fmt.Fprintf(h, "%s\x00", strings.TrimPrefix(path, workDir))
+				if _, err = io.Copy(h, file); err != nil {
+					return err
+				}
+				_, err = h.Write([]byte{0})
+				return err
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readPrepCache returns the result of the last APPSODY_PREP run, false if there is none
+func readPrepCache() (prepCacheEntry, bool) {
+	var entry prepCacheEntry
+	data, err := ioutil.ReadFile(prepCachePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ControllerWarning.log("Could not read the APPSODY_PREP cache ", err)
+		}
+		return entry, false
+	}
+	if err = json.Unmarshal(data, &entry); err != nil {
+		ControllerWarning.log("Ignoring the APPSODY_PREP cache ", prepCachePath(), " which is not valid: ", err)
+		return entry, false
+	}
+	return entry, true
+}
+
+// writePrepCache stores the result of an APPSODY_PREP run with the hash of its inputs after it ran,
+// as the command may have changed them, for instance by updating a lock file
+func writePrepCache(exitCode int) {
+	hash, err := hashPrepInputs(appsodyPREPCACHEINPUTS)
+	if err != nil {
+		ControllerWarning.log("Could not hash the APPSODY_PREP_CACHE_INPUTS, the APPSODY_PREP result is not cached: ", err)
+		return
+	}
+	data, err := json.MarshalIndent(prepCacheEntry{Hash: hash, Command: appsodyPREP, ExitCode: exitCode, Time: time.Now().UTC()}, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(prepCachePath()), 0755)
+	}
+	if err == nil {
+		// write a temporary file and rename it, so that the cache is never left half written
+		tmp := prepCachePath() + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, prepCachePath())
+		}
+	}
+	if err != nil {
+		ControllerWarning.log("Could not write the APPSODY_PREP cache ", err)
+		return
+	}
+	ControllerDebug.log("Stored the APPSODY_PREP result in ", prepCachePath(), ": exit code ", exitCode, ", inputs hash ", hash)
+}
+
+// runPrepCached runs APPSODY_PREP at startup, unless its inputs are unchanged since it last succeeded
+// and --force-prep was not given
+func runPrepCached(interactive bool) error {
+	if !prepCacheConfigured() {
+		return runPrep(interactive, nil)
+	}
+	if forcePrep {
+		ControllerInfo.log("Running APPSODY_PREP without checking the cache because --force-prep was specified.")
+	} else if hash, err := hashPrepInputs(appsodyPREPCACHEINPUTS); err != nil {
+		ControllerWarning.log("Could not hash the APPSODY_PREP_CACHE_INPUTS, running APPSODY_PREP: ", err)
+	} else if entry, found := readPrepCache(); found && entry.Hash == hash && entry.ExitCode == 0 {
+		ControllerInfo.log("Skipping APPSODY_PREP, the APPSODY_PREP_CACHE_INPUTS are unchanged since it succeeded at ",
+			entry.Time.Format(time.RFC3339), ". Use --force-prep to run it anyway.")
+		return nil
+	} else if found {
+		ControllerDebug.log("Running APPSODY_PREP, the inputs hash ", hash, " does not match the cached hash ", entry.Hash, " or the last run failed with exit code ", entry.ExitCode)
+	}
+	err := runPrep(interactive, nil)
+	if err != errPrepCancelled {
+		writePrepCache(prepExitCode(err))
+	}
+	return err
+}
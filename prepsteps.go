@@ -0,0 +1,249 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the name of the step when APPSODY_PREP is a single command
+const defaultPrepStepName = "prep"
+
+// how long to wait before a failed APPSODY_PREP step is retried
+const prepRetryDelay = time.Second
+
+// errPrepCancelled is returned when APPSODY_PREP is stopped by the shutdown or replaced by a newer run
+var errPrepCancelled = errors.New("APPSODY_PREP was stopped before it finished")
+
+// prepStep is one of the APPSODY_PREP commands, run in order
+type prepStep struct {
+	name    string
+	command string
+	timeout time.Duration
+	retries int
+}
+
+// prepStepConfig is a step of an APPSODY_PREP list, in the environment variable as JSON or in the configuration file
+type prepStepConfig struct {
+	Name    string    `json:"name" yaml:"name"`
+	Command string    `json:"command" yaml:"command"`
+	Timeout *duration `json:"timeout,omitempty" yaml:"timeout"`
+	Retries *int      `json:"retries,omitempty" yaml:"retries"`
+}
+
+// prepStepResult is the outcome of running a step
+type prepStepResult struct {
+	step     prepStep
+	attempts int
+	duration time.Duration
+	exitCode int
+	err      error
+}
+
+// prepFailure is the error returned when an APPSODY_PREP step fails, naming the step
+type prepFailure struct {
+	result prepStepResult
+}
+
+func (f prepFailure) Error() string {
+	return fmt.Sprintf("the APPSODY_PREP step %q failed after %v attempt(s): %v", f.result.step.name, f.result.attempts, f.result.err)
+}
+
+// whether an APPSODY_PREP run is in progress and the number of the latest run, protected by cmps.mu
+var (
+	prepRunning    bool
+	prepGeneration int
+)
+
+// isPrepStepList returns true if APPSODY_PREP is a JSON list of steps rather than a command
+func isPrepStepList(value string) bool {
+	return strings.HasPrefix(value, "[") && strings.HasPrefix(strings.TrimSpace(value[1:]), "{")
+}
+
+// computePrepSteps parses APPSODY_PREP, which is either one command or a JSON list of steps such as
+// [{"name": "install", "command": "npm ci", "timeout": "5m", "retries": 2}].
+// Steps without a timeout or retries use the APPSODY_PREP_TIMEOUT and APPSODY_PREP_RETRIES defaults.
+func computePrepSteps(envVar string, value string, timeout time.Duration, retries int) ([]prepStep, error) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return nil, nil
+	}
+	if !isPrepStepList(trimmed) {
+		return []prepStep{{name: defaultPrepStepName, command: value, timeout: timeout, retries: retries}}, nil
+	}
+	var configs []prepStepConfig
+	if err := json.Unmarshal([]byte(trimmed), &configs); err != nil {
+		return nil, configError{envVar, value, "The prep steps must be a JSON list of steps with a name, command, timeout and retries: " + err.Error()}
+	}
+	steps := make([]prepStep, len(configs))
+	for i, config := range configs {
+		step := prepStep{name: strings.TrimSpace(config.Name), command: config.Command, timeout: timeout, retries: retries}
+		if step.name == "" {
+			step.name = fmt.Sprintf("step %v", i+1)
+		}
+		if strings.TrimSpace(step.command) == "" {
+			return nil, configError{envVar, value, fmt.Sprintf("The prep step %q has no command", step.name)}
+		}
+		if config.Timeout != nil {
+			if config.Timeout.Duration < 0 {
+				return nil, configError{envVar, value, fmt.Sprintf("The timeout of the prep step %q can not be negative", step.name)}
+			}
+			step.timeout = config.Timeout.Duration
+		}
+		if config.Retries != nil {
+			if *config.Retries < 0 {
+				return nil, configError{envVar, value, fmt.Sprintf("The retries of the prep step %q can not be negative", step.name)}
+			}
+			step.retries = *config.Retries
+		}
+		steps[i] = step
+	}
+	return steps, nil
+}
+
+// computePrepTimeout parses APPSODY_PREP_TIMEOUT, the default timeout of each step in seconds, 0 for none
+func computePrepTimeout(envVar string, value string) (time.Duration, error) {
+	timeout, err := computeWholeNumber(envVar, value, 0, 0, "seconds")
+	return time.Duration(timeout) * time.Second, err
+}
+
+func (s prepStep) String() string {
+	description := s.name + ": " + s.command
+	var limits []string
+	if s.timeout > 0 {
+		limits = append(limits, "timeout "+s.timeout.String())
+	}
+	if s.retries > 0 {
+		limits = append(limits, fmt.Sprintf("retries %v", s.retries))
+	}
+	if len(limits) > 0 {
+		description += " (" + strings.Join(limits, ", ") + ")"
+	}
+	return description
+}
+
+// prepExitCode returns the exit code of the APPSODY_PREP step which failed, 0 if there is no error
+func prepExitCode(err error) int {
+	if failure, ok := err.(prepFailure); ok {
+		return failure.result.exitCode
+	}
+	return exitCodeFromError(err)
+}
+
+// runPrepStep runs a step until it succeeds or has been retried step.retries times
+func runPrepStep(step prepStep, generation int, interactive bool, env []string) prepStepResult {
+	result := prepStepResult{step: step}
+	started := time.Now()
+	for result.attempts = 1; ; result.attempts++ {
+		result.err = runPrepAttempt(step, generation, interactive, env)
+		if result.err == nil || result.err == errPrepCancelled || result.attempts > step.retries {
+			break
+		}
+		ControllerWarning.log("The APPSODY_PREP step \"", step.name, "\" failed (attempt ", result.attempts, " of ", step.retries+1, "): ", result.err, ", retrying it in ", prepRetryDelay)
+		time.Sleep(prepRetryDelay)
+	}
+	result.duration = time.Since(started)
+	result.exitCode = exitCodeFromError(result.err)
+	if result.err == nil {
+		ControllerInfo.log("The APPSODY_PREP step \"", step.name, "\" succeeded in ", result.duration.Round(time.Millisecond))
+	} else if result.err != errPrepCancelled {
+		ControllerError.log("The APPSODY_PREP step \"", step.name, "\" failed after ", result.attempts, " attempt(s) in ", result.duration.Round(time.Millisecond), ": ", result.err)
+	}
+	return result
+}
+
+// runPrepAttempt runs the command of a step once, stopping it if it runs for longer than the step timeout
+func runPrepAttempt(step prepStep, generation int, interactive bool, env []string) error {
+	cmps.mu.Lock()
+	// the processes stopped to run APPSODY_PREP again must be gone before it starts
+	waitForStops()
+	if cmps.shuttingDown || prepGeneration != generation {
+		cmps.mu.Unlock()
+		return errPrepCancelled
+	}
+	ControllerDebug.log("Running the APPSODY_PREP step ", step)
+	cmd, err := startProcess(step.command, prep, interactive, env)
+	if err != nil {
+		cmps.mu.Unlock()
+		return err
+	}
+	pid := cmd.Process.Pid
+	var timedOut int32
+	var timer *time.Timer
+	if step.timeout > 0 {
+		timer = time.AfterFunc(step.timeout, func() {
+			cmps.mu.Lock()
+			if cmps.pids[prep] != pid {
+				cmps.mu.Unlock()
+				return
+			}
+			atomic.StoreInt32(&timedOut, 1)
+			ControllerWarning.logProcess(prep, pid, "The APPSODY_PREP step \"", step.name, "\" did not finish within ", step.timeout, ", stopping it.")
+			stopping := detachProcess(prep)
+			cmps.mu.Unlock()
+			if err := stopping.stop(); err != nil {
+				ControllerWarning.log("Killing the APPSODY_PREP process received error ", err)
+			}
+		})
+	}
+	cmps.mu.Unlock()
+
+	err = waitProcess(cmd, prep)
+	if timer != nil {
+		timer.Stop()
+	}
+
+	cmps.mu.Lock()
+	defer cmps.mu.Unlock()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("timed out after %v", step.timeout)
+	}
+	if cmps.pids[prep] != pid {
+		// detachProcess clears the pid when a newer run replaces this one or the controller shuts down
+		ControllerDebug.logProcess(prep, pid, "The APPSODY_PREP process with pid ", pid, " was stopped before it finished.")
+		return errPrepCancelled
+	}
+	cmps.pids[prep] = 0
+	cmps.processes[prep] = nil
+	// processes the prep leaves running, such as a build daemon, are kept
+	releaseProcessTree(pid)
+	return err
+}
+
+// logPrepSummary logs the outcome of each APPSODY_PREP step, including the steps which did not run after a failure
+func logPrepSummary(results []prepStepResult, elapsed time.Duration) {
+	summary := make([]string, 0, len(appsodyPREPSTEPS))
+	for i, step := range appsodyPREPSTEPS {
+		if i >= len(results) {
+			summary = append(summary, step.name+" not run")
+			continue
+		}
+		result := results[i]
+		outcome := fmt.Sprintf("%v succeeded in %v", step.name, result.duration.Round(time.Millisecond))
+		if result.err != nil {
+			outcome = fmt.Sprintf("%v failed in %v (%v)", step.name, result.duration.Round(time.Millisecond), result.err)
+		}
+		if result.attempts > 1 {
+			outcome += fmt.Sprintf(" after %v attempts", result.attempts)
+		}
+		summary = append(summary, outcome)
+	}
+	ControllerInfo.log("APPSODY_PREP finished in ", elapsed.Round(time.Millisecond), ": ", strings.Join(summary, ", "))
+}
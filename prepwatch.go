@@ -0,0 +1,129 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"path/filepath"
+	"regexp"
+
+	"github.com/appsody/watcher"
+)
+
+// the compiled APPSODY_PREP_WATCH_REGEX, nil when APPSODY_PREP is not run again on file changes
+var prepWatchRegex *regexp.Regexp
+
+// validatePrepWatch checks that APPSODY_PREP_WATCH_REGEX compiles and has an APPSODY_PREP command to run
+func validatePrepWatch(envVar string, value string, prep string) error {
+	if value == "" {
+		return nil
+	}
+	if err := validateRegex(envVar, value, value); err != nil {
+		return err
+	}
+	if prep == "" {
+		return configError{envVar, value, "Running APPSODY_PREP again on file changes requires APPSODY_PREP to be set"}
+	}
+	return nil
+}
+
+// prepWatchConfigured returns true if APPSODY_PREP runs again when a file matching APPSODY_PREP_WATCH_REGEX changes
+func prepWatchConfigured() bool {
+	return appsodyPREP != "" && appsodyPREPWATCHREGEX != ""
+}
+
+// watchedFilesRegex returns the regular expression for the names of the files reported by the file watcher,
+// the files for the ON_CHANGE action and the dependency manifests which run APPSODY_PREP again
+func watchedFilesRegex() string {
+	if !prepWatchConfigured() {
+		return appsodyWATCHREGEX
+	}
+	return "(" + appsodyWATCHREGEX + ")|(" + appsodyPREPWATCHREGEX + ")"
+}
+
+// prepWatchMatch returns the first changed file matching APPSODY_PREP_WATCH_REGEX, or an empty string if there is none
+func prepWatchMatch(changedFiles []watcher.Event) string {
+	if prepWatchRegex == nil {
+		return ""
+	}
+	for _, event := range changedFiles {
+		if prepWatchRegex.MatchString(filepath.Base(event.Path)) {
+			return event.Path
+		}
+	}
+	return ""
+}
+
+// onFileChanges runs APPSODY_PREP again if a dependency manifest changed, otherwise the ON_CHANGE action
+func onFileChanges(fileChangeCommand string, killServer bool, interactive bool, changedFiles []watcher.Event) {
+	if path := prepWatchMatch(changedFiles); path != "" {
+		rerunPrep(path, interactive, changedFiles)
+		return
+	}
+	if onChangeConfigured() {
+		scheduleOnChange(fileChangeCommand, killServer, interactive, changedFiles)
+	}
+}
+
+// rerunPrep stops the managed processes, runs APPSODY_PREP again and then starts the APPSODY_RUN/DEBUG/TEST process.
+// ON_CHANGE actions are skipped while APPSODY_PREP runs, as the server they would act on is started once it succeeds.
+func rerunPrep(path string, interactive bool, changedFiles []watcher.Event) {
+	cmps.mu.Lock()
+	if cmps.shuttingDown {
+		cmps.mu.Unlock()
+		return
+	}
+	nextRestartCycle()
+	ControllerInfo.log("The dependency manifest ", path, " changed, stopping the APPSODY_RUN/DEBUG/TEST process to run APPSODY_PREP again.")
+	// a prep for older changes is out of date
+	prepGeneration++
+	var stopping []*stoppingProcess
+	for _, theProcessType := range []ProcessType{prep, fileWatcher, build, server} {
+		if theProcessType == server && cmps.pids[server] != 0 {
+			metricServerRestarts.inc(restartReasonPrep)
+		}
+		stopping = append(stopping, detachProcess(theProcessType))
+	}
+	stopDetached(stopping...)
+	cmps.mu.Unlock()
+
+	env := changedFilesEnv(changedFiles)
+	err := runPrep(interactive, env)
+	removeChangedFilesManifest(env)
+	if err == errPrepCancelled {
+		return
+	}
+	if prepCacheConfigured() {
+		writePrepCache(prepExitCode(err))
+	}
+
+	cmps.mu.Lock()
+	if cmps.shuttingDown || prepRunning {
+		// a newer change is running APPSODY_PREP again
+		cmps.mu.Unlock()
+		return
+	}
+	if err != nil {
+		ControllerError.log("The APPSODY_PREP command failed, the APPSODY_RUN/DEBUG/TEST process is not started. Fix the problem and save ", path, " to run APPSODY_PREP again.")
+		cancelPendingChange()
+		cmps.mu.Unlock()
+		return
+	}
+	ControllerInfo.log("The APPSODY_PREP command succeeded, starting the APPSODY_RUN/DEBUG/TEST process.")
+	if appsodyREADINESSPROBE == nil {
+		recordChangeReady()
+	}
+	cmps.mu.Unlock()
+	runCommands(startCommand, server, false, false, interactive, nil)
+}
@@ -0,0 +1,396 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Probe kinds, selected by the prefix of APPSODY_READINESS_PROBE or APPSODY_LIVENESS_PROBE
+const (
+	probeHTTP = "http"
+	probeTCP  = "tcp"
+	probeExec = "exec"
+	probeLog  = "log"
+)
+
+const (
+	defaultProbeInterval         = 2 * time.Second
+	defaultProbeTimeout          = 1 * time.Second
+	defaultProbeSuccessThreshold = 1
+	defaultProbeFailureThreshold = 3
+)
+
+type probeConfig struct {
+	name             string
+	kind             string
+	target           string
+	regex            *regexp.Regexp
+	interval         time.Duration
+	timeout          time.Duration
+	successThreshold int
+	failureThreshold int
+}
+
+// setupProbe reads the probe and its settings from the environment variables starting with envPrefix,
+// nil is returned if no probe is configured
+func setupProbe(name string, envPrefix string) (*probeConfig, error) {
+	spec := strings.TrimSpace(os.Getenv(envPrefix))
+	if spec == "" {
+		return nil, nil
+	}
+	probe := &probeConfig{name: name}
+	switch {
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		probe.kind = probeHTTP
+		probe.target = spec
+	case strings.HasPrefix(spec, "tcp:"):
+		probe.kind = probeTCP
+		probe.target = strings.TrimPrefix(spec, "tcp:")
+		if _, _, err := net.SplitHostPort(probe.target); err != nil {
+			return nil, configError{envPrefix, spec, "Invalid probe: " + err.Error()}
+		}
+	case strings.HasPrefix(spec, "exec:"):
+		probe.kind = probeExec
+		probe.target = strings.TrimPrefix(spec, "exec:")
+	case strings.HasPrefix(spec, "log:"):
+		probe.kind = probeLog
+		probe.target = strings.TrimPrefix(spec, "log:")
+		regex, err := regexp.Compile(probe.target)
+		if err != nil {
+			return nil, configError{envPrefix, spec, "Invalid probe: " + err.Error()}
+		}
+		probe.regex = regex
+	default:
+		return nil, configError{envPrefix, spec, "The probe must start with http://, https://, tcp:, exec: or log:"}
+	}
+
+	var err error
+	if probe.interval, err = probeSeconds(envPrefix+"_INTERVAL", defaultProbeInterval); err != nil {
+		return nil, err
+	}
+	if probe.timeout, err = probeSeconds(envPrefix+"_TIMEOUT", defaultProbeTimeout); err != nil {
+		return nil, err
+	}
+	if probe.successThreshold, err = probeThreshold(envPrefix+"_SUCCESS_THRESHOLD", defaultProbeSuccessThreshold); err != nil {
+		return nil, err
+	}
+	if probe.failureThreshold, err = probeThreshold(envPrefix+"_FAILURE_THRESHOLD", defaultProbeFailureThreshold); err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+func probeSeconds(envVar string, defaultValue time.Duration) (time.Duration, error) {
+	seconds, err := computeWholeNumber(envVar, os.Getenv(envVar), int(defaultValue/time.Second), 1, "seconds")
+	return time.Duration(seconds) * time.Second, err
+}
+
+func probeThreshold(envVar string, defaultValue int) (int, error) {
+	return computeWholeNumber(envVar, os.Getenv(envVar), defaultValue, 1, "probes")
+}
+
+func (p *probeConfig) String() string {
+	return fmt.Sprintf("%v %v probe %v every %v (timeout %v, success threshold %v, failure threshold %v)",
+		p.name, p.kind, p.target, p.interval, p.timeout, p.successThreshold, p.failureThreshold)
+}
+
+// probeRunner runs the probes for one server process
+type probeRunner struct {
+	pid  int
+	stop chan struct{}
+	once sync.Once
+
+	// mu protects the following.
+	mu         sync.Mutex
+	ready      bool
+	postStart  bool
+	successes  int
+	failures   int
+	logMatched bool
+	partial    []byte
+}
+
+var (
+	currentProbes *probeRunner
+	probesMu      sync.Mutex
+)
+
+// probesConfigured returns true if a readiness or liveness probe has been configured
+func probesConfigured() bool {
+	return appsodyREADINESSPROBE != nil || appsodyLIVENESSPROBE != nil
+}
+
+// probedProcess returns true if the process type is probed, the server or the ON_CHANGE process which takes its place
+// when APPSODY_RUN/DEBUG/TEST_KILL is true
+func probedProcess(theProcessType ProcessType) bool {
+	return probesConfigured() && (theProcessType == server || (theProcessType == fileWatcher && stopWatchServerOnChange && reloadSignal == 0))
+}
+
+// newProbeRunner creates the probe runner for a server process which is about to be started,
+// the probes start running once startProbes is called with the pid of the process
+func newProbeRunner() *probeRunner {
+	return &probeRunner{stop: make(chan struct{})}
+}
+
+// logWriter returns the writer which the server output is copied to when a log probe is configured
+func (r *probeRunner) logWriter() io.Writer {
+	if (appsodyREADINESSPROBE == nil || appsodyREADINESSPROBE.kind != probeLog) &&
+		(appsodyLIVENESSPROBE == nil || appsodyLIVENESSPROBE.kind != probeLog) {
+		return nil
+	}
+	return r
+}
+
+// Write matches each complete line of the server output against the log probe
+func (r *probeRunner) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.logMatched {
+		return len(p), nil
+	}
+	r.partial = append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := r.partial[:i]
+		r.partial = r.partial[i+1:]
+		if logProbeMatches(appsodyREADINESSPROBE, line) || logProbeMatches(appsodyLIVENESSPROBE, line) {
+			r.logMatched = true
+			r.partial = nil
+			break
+		}
+	}
+	return len(p), nil
+}
+
+func logProbeMatches(probe *probeConfig, line []byte) bool {
+	return probe != nil && probe.kind == probeLog && probe.regex.Match(line)
+}
+
+// start runs the configured probes against the server process with the given pid,
+// replacing the probes of any previous server process
+func (r *probeRunner) start(pid int) {
+	r.pid = pid
+	probesMu.Lock()
+	previous := currentProbes
+	currentProbes = r
+	probesMu.Unlock()
+	if previous != nil {
+		previous.stopProbes()
+	}
+	if appsodyREADINESSPROBE != nil {
+		ControllerDebug.log("Starting the ", appsodyREADINESSPROBE)
+		go r.run(appsodyREADINESSPROBE, r.readinessResult)
+	}
+	if appsodyLIVENESSPROBE != nil {
+		ControllerDebug.log("Starting the ", appsodyLIVENESSPROBE)
+		go r.run(appsodyLIVENESSPROBE, r.livenessResult())
+	}
+}
+
+func (r *probeRunner) stopProbes() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+}
+
+// stopServerProbes stops the probes once their server process has exited
+func stopServerProbes(pid int) {
+	probesMu.Lock()
+	r := currentProbes
+	if r != nil && r.pid == pid {
+		currentProbes = nil
+	}
+	probesMu.Unlock()
+	if r != nil && r.pid == pid {
+		r.stopProbes()
+	}
+}
+
+// serverReady returns whether the current server passed its readiness probe, nil if there is no readiness probe
+func serverReady() *bool {
+	if appsodyREADINESSPROBE == nil {
+		return nil
+	}
+	ready := false
+	probesMu.Lock()
+	r := currentProbes
+	probesMu.Unlock()
+	if r != nil {
+		r.mu.Lock()
+		ready = r.ready
+		r.mu.Unlock()
+	}
+	return &ready
+}
+
+// run checks the probe every interval until the probes are stopped, passing each result to handle.
+// handle returns false to stop probing.
+func (r *probeRunner) run(probe *probeConfig, handle func(probe *probeConfig, err error) bool) {
+	ticker := time.NewTicker(probe.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			err := r.check(probe)
+			select {
+			case <-r.stop:
+				// the server exited while it was being probed
+				return
+			default:
+			}
+			if !handle(probe, err) {
+				return
+			}
+		}
+	}
+}
+
+// check runs the probe once, returning nil if it succeeded
+func (r *probeRunner) check(probe *probeConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probe.timeout)
+	defer cancel()
+	switch probe.kind {
+	case probeHTTP:
+		req, err := http.NewRequest(http.MethodGet, probe.target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("HTTP status %v", resp.StatusCode)
+		}
+	case probeTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", probe.target)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	case probeExec:
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", probe.target)
+		cmd.Dir = workDir
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		// the probe is the leader of its own process group, which is killed when the probe times out
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		// a descendant which keeps the output open does not hold up Wait
+		cmd.WaitDelay = outputDrainTimeout
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := runChild(cmd)
+		if cmd.Process != nil {
+			// descendants of the probe do not outlive it
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		if err != nil && err != exec.ErrWaitDelay {
+			return fmt.Errorf("%v %s", err, bytes.TrimSpace(output.Bytes()))
+		}
+	case probeLog:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.logMatched {
+			return fmt.Errorf("no output has matched %v", probe.target)
+		}
+	}
+	return nil
+}
+
+// readinessResult tracks the ready state, it changes after successThreshold successes or failureThreshold failures in a row
+func (r *probeRunner) readinessResult(probe *probeConfig, err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.failures = 0
+		r.successes++
+		if !r.ready && r.successes >= probe.successThreshold {
+			r.ready = true
+			ControllerInfo.logProcess(server, r.pid, "The APPSODY_RUN/DEBUG/TEST process with pid ", r.pid, " is ready.")
+			publishProcessEvent(eventServerReady, server, r.pid)
+			recordChangeReady()
+			if !r.postStart {
+				// the APPSODY_RUN/DEBUG/TEST_POST_START hook runs the first time the server is ready
+				r.postStart = true
+				startHook(hookPostStart, serverPidEnv(r.pid))
+			}
+		}
+		return true
+	}
+	r.successes = 0
+	r.failures++
+	ControllerDebug.logProcess(server, r.pid, "The readiness probe failed for pid ", r.pid, ": ", err)
+	if r.ready && r.failures >= probe.failureThreshold {
+		r.ready = false
+		ControllerWarning.logProcess(server, r.pid, "The APPSODY_RUN/DEBUG/TEST process with pid ", r.pid, " is not ready: ", err)
+		publishProcessEvent(eventServerNotReady, server, r.pid)
+	}
+	return true
+}
+
+// livenessResult returns the handler for the liveness probe, which restarts the server after failureThreshold failures in a row.
+// Failures are only counted once the probe has succeeded, so a slow starting server is not restarted.
+func (r *probeRunner) livenessResult() func(probe *probeConfig, err error) bool {
+	alive := false
+	failures := 0
+	return func(probe *probeConfig, err error) bool {
+		if err == nil {
+			alive = true
+			failures = 0
+			return true
+		}
+		if !alive {
+			ControllerDebug.logProcess(server, r.pid, "The liveness probe has not succeeded yet for pid ", r.pid, ": ", err)
+			return true
+		}
+		failures++
+		ControllerDebug.logProcess(server, r.pid, "The liveness probe failed for pid ", r.pid, ": ", err)
+		if failures < probe.failureThreshold {
+			return true
+		}
+		if controllerMode == "debug" {
+			// a debugger stopped at a breakpoint fails the liveness probe, so the server is never restarted in debug mode
+			ControllerWarning.logProcess(server, r.pid, "The liveness probe failed ", failures, " times for pid ", r.pid, ", the server is not restarted in debug mode: ", err)
+			failures = 0
+			return true
+		}
+		ControllerWarning.logProcess(server, r.pid, "The liveness probe failed ", failures, " times for pid ", r.pid, ", restarting the APPSODY_RUN/DEBUG/TEST process: ", err)
+		publishProcessEvent(eventLivenessFailed, server, r.pid)
+		go restartServer(restartReasonLiveness)
+		return false
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Values for APPSODY_PROCESS_TRACKING
+const (
+	// only the process group of the process is stopped
+	processTrackingGroup = "group"
+	// the descendants of the process are found by walking /proc
+	processTrackingProc = "proc"
+	// each process runs in its own cgroup v2 sub-group, and /proc is walked as well
+	processTrackingCgroup = "cgroup"
+)
+
+// processMarkerEnv is set for each process the controller starts when the process tree is tracked,
+// the descendants inherit it, so it identifies them after they have left the process group or been reparented
+const processMarkerEnv = "APPSODY_CONTROLLER_PROCESS"
+
+// processTree is the tracking of the descendants of a process started by the controller
+type processTree struct {
+	marker string
+	// the cgroup v2 directory of the process, empty if the descendants are only found through /proc
+	cgroup string
+}
+
+var (
+	processTrees   = make(map[int]*processTree)
+	processTreesMu sync.Mutex
+	processMarkers int64
+	// the fallback from cgroups to /proc is only logged for the first process
+	cgroupFallback sync.Once
+)
+
+// computeProcessTracking parses an APPSODY_PROCESS_TRACKING value, which defaults to group
+func computeProcessTracking(envVar string, value string) (string, error) {
+	tracking := strings.ToLower(strings.TrimSpace(value))
+	switch tracking {
+	case processTrackingGroup, processTrackingProc, processTrackingCgroup:
+		return tracking, nil
+	case "":
+		return processTrackingGroup, nil
+	}
+	return processTrackingGroup, configError{envVar, value, "The process tracking must be one of group, proc or cgroup"}
+}
+
+// newProcessMarker returns the environment variable which marks the descendants of a process about to be started,
+// or an empty string if the process tree is not tracked
+func newProcessMarker() string {
+	if appsodyPROCESSTRACKING == processTrackingGroup {
+		return ""
+	}
+	id := atomic.AddInt64(&processMarkers, 1)
+	return processMarkerEnv + "=" + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(id, 10)
+}
+
+// trackProcessTree starts tracking the descendants of a process which has just been started with the marker
+func trackProcessTree(pid int, marker string, theProcessType ProcessType) {
+	if marker == "" {
+		return
+	}
+	tree := &processTree{marker: marker}
+	if appsodyPROCESSTRACKING == processTrackingCgroup {
+		dir, err := moveToCgroup(pid, "appsody-"+eventProcessTypes[theProcessType]+"-"+strconv.Itoa(pid))
+		if err != nil {
+			cgroupFallback.Do(func() {
+				ControllerWarning.log("Could not run the controller managed processes in their own cgroups, their descendants are only found through /proc: ", err)
+			})
+		} else {
+			ControllerDebug.logProcess(theProcessType, pid, "The ", processTypeToString(theProcessType), " process with pid ", pid, " runs in the cgroup ", dir)
+			tree.cgroup = dir
+		}
+	}
+	processTreesMu.Lock()
+	processTrees[pid] = tree
+	processTreesMu.Unlock()
+}
+
+// processTreeMembers returns the live descendants of a tracked process, not including the process itself
+func processTreeMembers(pid int) []int {
+	processTreesMu.Lock()
+	tree := processTrees[pid]
+	processTreesMu.Unlock()
+	if tree == nil {
+		return nil
+	}
+	// the process is only moved into its cgroup once it has started, so /proc is walked as well
+	// for descendants which it started before the move and which were left outside the cgroup
+	members := descendants(pid, tree.marker)
+	if tree.cgroup != "" {
+		members = append(members, cgroupMembers(tree.cgroup)...)
+	}
+	seen := make(map[int]bool)
+	var alive []int
+	for _, member := range members {
+		if !seen[member] && member != pid && member != os.Getpid() && syscall.Kill(member, syscall.Signal(0)) == nil {
+			seen[member] = true
+			alive = append(alive, member)
+		}
+	}
+	return alive
+}
+
+// signalProcessTree sends the signal to every descendant of a tracked process, including those outside its process group
+func signalProcessTree(pid int, sig syscall.Signal) {
+	for _, member := range processTreeMembers(pid) {
+		_ = syscall.Kill(member, sig)
+	}
+}
+
+// stopLeftovers kills the descendants of a tracked process which are still running after the process has stopped,
+// reporting each of them, and then releases the process tree
+func stopLeftovers(pid int, theProcessType ProcessType) {
+	if pid == 0 {
+		return
+	}
+	leftovers := processTreeMembers(pid)
+	if len(leftovers) > 0 {
+		described := make([]string, len(leftovers))
+		for i, leftover := range leftovers {
+			described[i] = strconv.Itoa(leftover) + " (" + processName(leftover) + ")"
+			_ = syscall.Kill(leftover, syscall.SIGKILL)
+		}
+		ControllerWarning.logProcess(theProcessType, pid, "The ", processTypeToString(theProcessType), " process with pid ", pid, " left ", len(leftovers),
+			" descendant process(es) running, they were killed with SIGKILL: ", strings.Join(described, ", "))
+		publishEvent(controllerEvent{Type: eventLeftoversKilled, ProcessType: eventProcessTypes[theProcessType], Pid: pid, Message: strings.Join(described, ", ")})
+	}
+	releaseProcessTree(pid)
+}
+
+// releaseProcessTree stops tracking a process, removing its cgroup if it is empty
+func releaseProcessTree(pid int) {
+	processTreesMu.Lock()
+	tree := processTrees[pid]
+	delete(processTrees, pid)
+	processTreesMu.Unlock()
+	if tree != nil && tree.cgroup != "" {
+		if err := removeCgroup(tree.cgroup); err != nil {
+			ControllerDebug.log("Could not remove the cgroup ", tree.cgroup, " ", err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the mount point of the cgroup v2 unified hierarchy
+const cgroupRoot = "/sys/fs/cgroup"
+
+// descendants returns the processes below the process in the process tree, and the processes carrying its
+// marker in their environment, which were started by its descendants but have since been reparented
+func descendants(pid int, marker string) []int {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	children := make(map[int][]int)
+	found := make(map[int]bool)
+	markerBytes := []byte(marker)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if _, ppid, ok := processState(child); ok {
+			children[ppid] = append(children[ppid], child)
+		}
+		if environ, err := ioutil.ReadFile("/proc/" + entry.Name() + "/environ"); err == nil {
+			for _, variable := range bytes.Split(environ, []byte{0}) {
+				if bytes.Equal(variable, markerBytes) {
+					found[child] = true
+					break
+				}
+			}
+		}
+	}
+	// everything below the process or below a marked process
+	var queue []int
+	queue = append(queue, pid)
+	for marked := range found {
+		queue = append(queue, marked)
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, child := range children[next] {
+			if !found[child] {
+				found[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	pids := make([]int, 0, len(found))
+	for member := range found {
+		pids = append(pids, member)
+	}
+	return pids
+}
+
+// processName returns the command name of a process
+func processName(pid int) string {
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// controllerCgroup returns the cgroup v2 directory of the controller
+func controllerCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", errors.New("the cgroup v2 unified hierarchy is not mounted at " + cgroupRoot)
+	}
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(cgroupRoot, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", errors.New("the controller is not in a cgroup v2 group")
+}
+
+// moveToCgroup creates a sub-group of the controller's cgroup and moves the process into it
+func moveToCgroup(pid int, name string) (string, error) {
+	parent, err := controllerCgroup()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(parent, name)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		_ = os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// cgroupMembers returns the processes in the cgroup
+func cgroupMembers(dir string) []int {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, line := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// removeCgroup removes the cgroup once the processes killed in it have gone
+func removeCgroup(dir string) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = os.Remove(dir); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+// +build !linux
+
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"errors"
+	"strconv"
+)
+
+// /proc and cgroups are only available on Linux, elsewhere only the process group is stopped
+func descendants(pid int, marker string) []int {
+	return nil
+}
+
+func processName(pid int) string {
+	return "pid " + strconv.Itoa(pid)
+}
+
+func moveToCgroup(pid int, name string) (string, error) {
+	return "", errors.New("cgroups are not supported on this platform")
+}
+
+func cgroupMembers(dir string) []int {
+	return nil
+}
+
+func removeCgroup(dir string) error {
+	return nil
+}
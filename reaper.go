@@ -0,0 +1,94 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// reaperMu is held while a command is started and while the reaper looks for orphaned processes,
+// so that the reaper never sees a child of the controller before its pid is recorded in startedPids
+var reaperMu sync.Mutex
+
+// the pids of the commands started by the controller, their exit status is left for exec.Cmd.Wait
+var startedPids = make(map[int]bool)
+
+// startChild starts the command, the reaper leaves it alone until waitChild has collected its exit status
+func startChild(cmd *exec.Cmd) error {
+	reaperMu.Lock()
+	defer reaperMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	startedPids[cmd.Process.Pid] = true
+	return nil
+}
+
+// waitChild waits for a command started by startChild
+func waitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	reaperMu.Lock()
+	delete(startedPids, cmd.Process.Pid)
+	reaperMu.Unlock()
+	return err
+}
+
+// runChild starts the command and waits for it to finish
+func runChild(cmd *exec.Cmd) error {
+	if err := startChild(cmd); err != nil {
+		return err
+	}
+	return waitChild(cmd)
+}
+
+// startReaper reaps the orphaned processes which are reparented to the controller each time a SIGCHLD arrives,
+// for as long as the controller runs. Unless the controller is PID 1 it makes itself the child subreaper
+// so that the orphans of the processes it starts are reparented to it rather than to PID 1.
+func startReaper() {
+	if os.Getpid() != 1 {
+		if err := setChildSubreaper(); err != nil {
+			ControllerDebug.log("Could not make the controller the child subreaper: ", err)
+		}
+	}
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		for range sigchld {
+			reapOrphans()
+		}
+	}()
+	// orphans which exited before the signal handler was in place
+	reapOrphans()
+}
+
+// reapOrphans collects the exit status of each child process which has exited and was not started by the controller
+func reapOrphans() {
+	reaperMu.Lock()
+	defer reaperMu.Unlock()
+	for _, pid := range exitedChildren() {
+		if startedPids[pid] {
+			continue
+		}
+		var wstatus syscall.WaitStatus
+		reaped, err := syscall.Wait4(pid, &wstatus, syscall.WNOHANG, nil)
+		if err == nil && reaped == pid {
+			ControllerDebug.log("Reaped the orphaned process with pid ", pid, " exit status ", wstatus.ExitStatus())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/appsody/watcher"
+)
+
+// the signals which can be used for APPSODY_RUN/DEBUG/TEST_RELOAD_SIGNAL
+var reloadSignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// computeReloadSignal parses an APPSODY_RUN/DEBUG/TEST_RELOAD_SIGNAL value such as SIGHUP or USR2,
+// 0 is returned when it is not set and the server is restarted on change
+func computeReloadSignal(envVar string, value string) (syscall.Signal, error) {
+	name := strings.ToUpper(strings.TrimSpace(value))
+	if name == "" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, found := reloadSignals[name]; found {
+		return sig, nil
+	}
+	return 0, configError{envVar, value, "The reload signal must be one of SIGHUP, SIGUSR1 or SIGUSR2"}
+}
+
+// reloadSignalName returns the name of a reload signal, or an empty string when there is none
+func reloadSignalName(sig syscall.Signal) string {
+	if sig == 0 {
+		return ""
+	}
+	return signalName(sig)
+}
+
+// onChangeConfigured returns true if the mode has an ON_CHANGE command or a reload signal for file changes
+func onChangeConfigured() bool {
+	return fileChangeCommand != "" || reloadSignal != 0
+}
+
+// fileWatchingConfigured returns true if the file watcher runs, for the ON_CHANGE action or to run APPSODY_PREP again
+func fileWatchingConfigured() bool {
+	return onChangeConfigured() || prepWatchConfigured()
+}
+
+// reloadServer sends the reload signal to the server process group in place of restarting the server,
+// running the ON_CHANGE command to completion first if there is one.
+// It is called with cmps.mu locked and returns with it unlocked.
+// The server is restarted if it is no longer running.
+func reloadServer(commandString string, interactive bool, changedFiles []watcher.Event, generation int) {
+	// an ON_CHANGE command for older changes is out of date
+	stopDetached(detachProcess(fileWatcher))
+	if onChangeReplaced(generation) {
+		cmps.mu.Unlock()
+		return
+	}
+	var cmd *exec.Cmd
+	var err error
+	if commandString != "" {
+		env := changedFilesEnv(changedFiles)
+		cmd, err = startProcess(commandString, fileWatcher, interactive, env)
+		if err != nil {
+			ControllerWarning.log("Received an error starting the APPSODY_RUN/DEBUG/TEST_ON_CHANGE command: ", commandString, " error received was: ", err)
+			removeChangedFilesManifest(env)
+			cancelPendingChange()
+			cmps.mu.Unlock()
+			return
+		}
+		cmps.mu.Unlock()
+
+		err = waitProcess(cmd, fileWatcher)
+		removeChangedFilesManifest(env)
+
+		cmps.mu.Lock()
+		if cmps.pids[fileWatcher] != cmd.Process.Pid {
+			// detachProcess clears the pid when a newer change replaces this one or the controller shuts down
+			ControllerDebug.logProcess(fileWatcher, cmd.Process.Pid, "The APPSODY_RUN/DEBUG/TEST_ON_CHANGE process with pid ", cmd.Process.Pid, " was stopped before it finished.")
+			cmps.mu.Unlock()
+			return
+		}
+		cmps.pids[fileWatcher] = 0
+		cmps.processes[fileWatcher] = nil
+		if err != nil {
+			ControllerError.logProcess(fileWatcher, cmd.Process.Pid, "The APPSODY_RUN/DEBUG/TEST_ON_CHANGE command failed with exit code ", exitCodeFromError(err),
+				", the APPSODY_RUN/DEBUG/TEST process is not reloaded.")
+			cancelPendingChange()
+			cmps.mu.Unlock()
+			return
+		}
+	}
+	if cmps.shuttingDown {
+		cmps.mu.Unlock()
+		return
+	}
+
+	process := cmps.processes[server]
+	if cmps.pids[server] != 0 && process != nil && process.Signal(syscall.Signal(0)) == nil {
+		pid := process.Pid
+		ControllerDebug.logProcess(server, pid, "Sending ", signalName(reloadSignal), " to pid:  ", -pid)
+		err = syscall.Kill(-pid, reloadSignal)
+		if err == nil {
+			// descendants which have left the process group
+			signalProcessTree(pid, reloadSignal)
+			ControllerInfo.logProcess(server, pid, "Sent ", signalName(reloadSignal), " to the APPSODY_RUN/DEBUG/TEST process group ", pid, " to reload it.")
+			publishProcessEvent(eventServerReloaded, server, pid)
+			recordChangeReady()
+			startHook(hookPostChange, changedFilesEnv(changedFiles))
+			cmps.mu.Unlock()
+			return
+		}
+		if err != syscall.ESRCH {
+			ControllerWarning.logProcess(server, pid, "Could not send ", signalName(reloadSignal), " to the APPSODY_RUN/DEBUG/TEST process group ", pid, " ", err)
+			cancelPendingChange()
+			cmps.mu.Unlock()
+			return
+		}
+	}
+
+	if cmps.serverRestarting {
+		// an older ON_CHANGE action is restarting the server already
+		cmps.mu.Unlock()
+		return
+	}
+	ControllerWarning.log("The APPSODY_RUN/DEBUG/TEST process is not running, falling back to a full restart.")
+	metricServerRestarts.inc(restartReasonOnChange)
+	if appsodyREADINESSPROBE == nil {
+		recordChangeReady()
+	}
+	// runCommands goes on waiting for the restarted server, the change has been applied once it has started
+	cmps.serverRestarting = true
+	cmps.mu.Unlock()
+	runCommands(startCommand, server, false, false, interactive, nil)
+}
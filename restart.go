@@ -0,0 +1,108 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"strings"
+	"time"
+)
+
+// Values for APPSODY_RUN/DEBUG/TEST_RESTART
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+const (
+	defaultRestartMaxRetries = 5
+	defaultRestartBackoff    = 1 * time.Second
+	// the backoff doubles after every restart up to this limit
+	maxRestartBackoff = 60 * time.Second
+	// a server which stays up for this long is no longer considered to be crash looping
+	restartResetPeriod = 30 * time.Second
+)
+
+// computeRestartPolicy returns the restart policy for an APPSODY_RUN/DEBUG/TEST_RESTART value, defaulting to never
+func computeRestartPolicy(envVar string, value string) (string, error) {
+	policy := strings.ToLower(strings.TrimSpace(value))
+	switch policy {
+	case restartNever, restartOnFailure, restartAlways:
+		return policy, nil
+	case "":
+		return restartNever, nil
+	}
+	return restartNever, configError{envVar, value, "The restart policy must be one of never, on-failure or always"}
+}
+
+// computeRestartMaxRetries parses APPSODY_RESTART_MAX_RETRIES, which must be at least 1
+func computeRestartMaxRetries(value string) (int, error) {
+	return computeWholeNumber("APPSODY_RESTART_MAX_RETRIES", value, defaultRestartMaxRetries, 1, "restarts")
+}
+
+// computeRestartBackoff parses APPSODY_RESTART_BACKOFF, the initial backoff in milliseconds
+func computeRestartBackoff(value string) (time.Duration, error) {
+	backoff, err := computeWholeNumber("APPSODY_RESTART_BACKOFF", value, int(defaultRestartBackoff/time.Millisecond), 0, "milliseconds")
+	return time.Duration(backoff) * time.Millisecond, err
+}
+
+// describeRestartReason returns why the server is restarted by the control API or the liveness probe, for the log
+func describeRestartReason(reason string) string {
+	if reason == restartReasonLiveness {
+		return "because the liveness probe failed"
+	}
+	return "at the request of the control API"
+}
+
+// restartTracker decides whether a server which exited on its own is restarted, and after how long
+type restartTracker struct {
+	policy     string
+	maxRetries int
+	backoff    time.Duration
+	retries    int
+}
+
+func newRestartTracker(policy string) *restartTracker {
+	return &restartTracker{
+		policy:     policy,
+		maxRetries: appsodyRESTARTMAXRETRIES,
+		backoff:    appsodyRESTARTBACKOFF,
+	}
+}
+
+// next returns the backoff before the server is restarted, or false if it should not be restarted
+func (t *restartTracker) next(exitCode int, ranFor time.Duration) (time.Duration, bool) {
+	if t.policy == restartNever || (t.policy == restartOnFailure && exitCode == 0) {
+		return 0, false
+	}
+	if ranFor >= restartResetPeriod {
+		t.retries = 0
+	}
+	if t.retries >= t.maxRetries {
+		ControllerError.log("The APPSODY_RUN/DEBUG/TEST process is crash looping, it exited ", t.retries+1, " times in a row within ", restartResetPeriod,
+			" of starting, last exit code ", exitCode, ". It will not be restarted again automatically.")
+		publishEvent(controllerEvent{Type: eventCrashLoop, ProcessType: eventProcessTypes[server], ExitCode: &exitCode})
+		return 0, false
+	}
+	backoff := t.backoff
+	for i := 0; i < t.retries && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	t.retries++
+	return backoff, true
+}
@@ -0,0 +1,125 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the signals which can be used for APPSODY_FORWARD_SIGNALS
+var forwardableSignals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+	"SIGQUIT":  syscall.SIGQUIT,
+}
+
+// no signals are forwarded when APPSODY_FORWARD_SIGNALS is not set, so that SIGHUP still ends the controller
+// and SIGQUIT still shuts it down
+var defaultForwardSignals = []syscall.Signal{}
+
+// computeForwardSignals parses an APPSODY_FORWARD_SIGNALS value, a comma or space separated list of signals
+// such as SIGHUP,SIGUSR2 or none
+func computeForwardSignals(envVar string, value string) ([]syscall.Signal, error) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return defaultForwardSignals, nil
+	}
+	if strings.EqualFold(trimmed, "none") {
+		return []syscall.Signal{}, nil
+	}
+	var signals []syscall.Signal
+	for _, name := range strings.FieldsFunc(strings.ToUpper(trimmed), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		sig, found := forwardableSignals[name]
+		if !found {
+			return defaultForwardSignals, configError{envVar, value, "The forwarded signals must be none or a list of SIGHUP, SIGUSR1, SIGUSR2, SIGWINCH and SIGQUIT"}
+		}
+		signals = append(signals, sig)
+	}
+	return signals, nil
+}
+
+// forwardsSignal returns true if the signal is forwarded rather than handled by the controller
+func forwardsSignal(sig syscall.Signal) bool {
+	for _, forwarded := range appsodyFORWARDSIGNALS {
+		if forwarded == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// signalNames returns the names of the signals for logging, for instance SIGHUP, SIGUSR2, or none
+func signalNames(signals []syscall.Signal) string {
+	if len(signals) == 0 {
+		return "none"
+	}
+	names := make([]string, len(signals))
+	for i, sig := range signals {
+		names[i] = signalName(sig)
+	}
+	return strings.Join(names, ", ")
+}
+
+// startSignalForwarding forwards the APPSODY_FORWARD_SIGNALS signals received by the controller to the server
+func startSignalForwarding() {
+	if len(appsodyFORWARDSIGNALS) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	for _, sig := range appsodyFORWARDSIGNALS {
+		signal.Notify(signals, sig)
+	}
+	ControllerDebug.log("Forwarding ", signalNames(appsodyFORWARDSIGNALS), " to the APPSODY_RUN/DEBUG/TEST process group.")
+	go func() {
+		for sig := range signals {
+			forwardSignal(sig.(syscall.Signal))
+		}
+	}()
+}
+
+// servingProcess returns the process type and pid of the server, or of the ON_CHANGE process which replaces
+// the server when APPSODY_RUN/DEBUG/TEST_KILL is true, the pid is 0 if there is neither
+func servingProcess() (ProcessType, int) {
+	cmps.mu.RLock()
+	defer cmps.mu.RUnlock()
+	pid := cmps.pids[server]
+	if pid == 0 && stopWatchServerOnChange {
+		return fileWatcher, cmps.pids[fileWatcher]
+	}
+	return server, pid
+}
+
+// forwardSignal sends the signal to the process group of the server or the ON_CHANGE process replacing it
+func forwardSignal(sig syscall.Signal) {
+	theProcessType, pid := servingProcess()
+	if pid == 0 {
+		ControllerDebug.log("Received ", signalName(sig), " but there is no APPSODY_RUN/DEBUG/TEST process to forward it to.")
+		return
+	}
+	if err := syscall.Kill(-pid, sig); err != nil {
+		ControllerWarning.logProcess(theProcessType, pid, "Could not forward ", signalName(sig), " to the ", processTypeToString(theProcessType), " process group ", pid, " ", err)
+		return
+	}
+	ControllerInfo.logProcess(theProcessType, pid, "Forwarded ", signalName(sig), " to the ", processTypeToString(theProcessType), " process group ", strconv.Itoa(pid))
+}
@@ -0,0 +1,215 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultStopSignal  = syscall.SIGINT
+	defaultStopTimeout = 5 * time.Second
+	// how often a stopping process is checked
+	stopPollInterval = 100 * time.Millisecond
+)
+
+// the signals which can be used for APPSODY_RUN/DEBUG/TEST_STOP_SIGNAL
+var stopSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// signalName returns the name of a signal, for instance SIGINT
+func signalName(sig syscall.Signal) string {
+	for name, value := range stopSignals {
+		if value == sig {
+			return name
+		}
+	}
+	for name, value := range forwardableSignals {
+		if value == sig {
+			return name
+		}
+	}
+	return "signal " + strconv.Itoa(int(sig))
+}
+
+// computeStopSignal parses an APPSODY_RUN/DEBUG/TEST_STOP_SIGNAL value such as SIGTERM, TERM or 15, defaulting to SIGINT
+func computeStopSignal(envVar string, value string) (syscall.Signal, error) {
+	name := strings.ToUpper(strings.TrimSpace(value))
+	if name == "" {
+		return defaultStopSignal, nil
+	}
+	if number, err := strconv.Atoi(name); err == nil {
+		name = signalName(syscall.Signal(number))
+	} else if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, found := stopSignals[name]; found {
+		return sig, nil
+	}
+	return defaultStopSignal, configError{envVar, value, "The stop signal must be one of SIGINT, SIGTERM, SIGKILL, SIGHUP, SIGQUIT, SIGUSR1 or SIGUSR2"}
+}
+
+// computeStopTimeout parses an APPSODY_RUN/DEBUG/TEST_STOP_TIMEOUT value, the grace period in seconds after each signal
+func computeStopTimeout(envVar string, value string) (time.Duration, error) {
+	timeout, err := computeWholeNumber(envVar, value, int(defaultStopTimeout/time.Second), 0, "seconds")
+	return time.Duration(timeout) * time.Second, err
+}
+
+// stopSequence is the stop signal for the mode followed by SIGTERM and SIGKILL
+func stopSequence(first syscall.Signal) []syscall.Signal {
+	sequence := []syscall.Signal{first}
+	if first != syscall.SIGTERM && first != syscall.SIGKILL {
+		sequence = append(sequence, syscall.SIGTERM)
+	}
+	if first != syscall.SIGKILL {
+		sequence = append(sequence, syscall.SIGKILL)
+	}
+	return sequence
+}
+
+// stoppingProcess is a process taken out of cmps by detachProcess, which is stopped by calling stop once cmps.mu is unlocked
+type stoppingProcess struct {
+	process     *os.Process
+	processType ProcessType
+	serving     bool // the PRE_STOP hook runs before the process is stopped
+}
+
+// detachProcess takes the process of the type out of cmps, so that the controller no longer manages it, and returns it to be stopped.
+// It is called with cmps.mu locked, and returns nil if there is no such process.
+// The stop sequence can take up to three stop timeouts, so the caller stops the process with stop once cmps.mu is unlocked.
+func detachProcess(theProcessType ProcessType) *stoppingProcess {
+	processPid := cmps.pids[theProcessType]
+	ControllerDebug.log("Attempting to kill pid: ", processPid)
+	if processPid == 0 {
+		return nil
+	}
+	stopping := &stoppingProcess{process: cmps.processes[theProcessType], processType: theProcessType, serving: isServingProcess(theProcessType)}
+	cmps.processes[theProcessType] = nil
+	cmps.pids[theProcessType] = 0
+	cmps.stopping++
+	return stopping
+}
+
+// stop stops the process group of the detached process with the stop sequence for the mode, see stopProcessGroup.
+// It is called without cmps.mu locked, p may be nil.
+func (p *stoppingProcess) stop() error {
+	if p == nil {
+		return nil
+	}
+	defer func() {
+		cmps.mu.Lock()
+		cmps.stopping--
+		cmps.stopped.Broadcast()
+		cmps.mu.Unlock()
+	}()
+	processPid := p.process.Pid
+	// Check to see if the process is still alive to avoid unncessary kill steps
+	if p.process.Signal(syscall.Signal(0)) != nil {
+		ControllerDebug.log("No such process for pid:  ", processPid)
+		// the process exited on its own, but its descendants may not have
+		stopLeftovers(processPid, p.processType)
+		return nil
+	}
+	if p.serving {
+		// the hook runs while the server is still up, for instance to flush a cache
+		_ = runHook(hookPreStop, serverPidEnv(processPid))
+	}
+	started := time.Now()
+	err := stopProcessGroup(p.process, p.processType)
+	metricKillDuration.observe(time.Since(started), eventProcessTypes[p.processType])
+	return err
+}
+
+// stopDetached stops the processes taken out of cmps by detachProcess and waits for any other stop in progress.
+// It is called with cmps.mu locked and returns with it locked, the lock is released while the processes stop,
+// so the caller checks again whether it has been replaced or the controller is shutting down.
+func stopDetached(processes ...*stoppingProcess) {
+	cmps.mu.Unlock()
+	for _, p := range processes {
+		if err := p.stop(); err != nil {
+			// do nothing we continue after kill errors
+			ControllerWarning.log("Killing the ", processTypeToString(p.processType), " process received error ", err)
+		}
+	}
+	cmps.mu.Lock()
+	waitForStops()
+}
+
+// waitForStops waits until every process detached from cmps has been stopped, so that a new process does not start
+// alongside the one it replaces. It is called with cmps.mu locked, the lock is released while it waits.
+func waitForStops() {
+	for cmps.stopping > 0 {
+		cmps.stopped.Wait()
+	}
+}
+
+// stopProcessGroup sends each signal of the stop sequence to the process group of the process,
+// waiting up to the stop timeout after each one for the process to exit
+func stopProcessGroup(process *os.Process, theProcessType ProcessType) error {
+	pid := process.Pid
+	for i, sig := range stopSequence(stopSignal) {
+		if i > 0 {
+			ControllerWarning.logProcess(theProcessType, pid, "The ", processTypeToString(theProcessType), " process with pid ", pid, " did not stop within ", stopTimeout, ", sending ", signalName(sig))
+		}
+		ControllerDebug.logProcess(theProcessType, pid, "Sending ", signalName(sig), " to pid:  ", -pid)
+		if err := syscall.Kill(-pid, sig); err != nil {
+			if err == syscall.ESRCH {
+				// the process group has already gone
+				stopLeftovers(pid, theProcessType)
+				return nil
+			}
+			ControllerError.logProcess(theProcessType, pid, "Killing process ", pid, " returned an error ", signalName(sig), " received error ", err)
+			return err
+		}
+		// descendants which have left the process group
+		signalProcessTree(pid, sig)
+		if i == 0 {
+			publishProcessEvent(eventProcessKilled, theProcessType, pid)
+		}
+		if waitForExit(process, stopTimeout) {
+			ControllerInfo.logProcess(theProcessType, pid, "The ", processTypeToString(theProcessType), " process with pid ", pid, " was stopped by ", signalName(sig))
+			stopLeftovers(pid, theProcessType)
+			return nil
+		}
+	}
+	ControllerError.logProcess(theProcessType, pid, "The ", processTypeToString(theProcessType), " process with pid ", pid, " is still running after SIGKILL")
+	stopLeftovers(pid, theProcessType)
+	return nil
+}
+
+// waitForExit returns true if the process exits within the timeout
+func waitForExit(process *os.Process, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if process.Signal(syscall.Signal(0)) != nil {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+}
@@ -14,11 +14,19 @@
 package test
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // TestInvalidWatchDirs
@@ -45,7 +53,7 @@ func TestInvalidWatchDirs(t *testing.T) {
 
 			The test checks to see if empty APPSODY_WATCH_DIR and APPSODY_MOUNTS are flagged.
 		*/
-		args := []string{"unset APPSODY_WATCH_DIR;unset APPSODY_MOUNTS;export APPSODY_RUN=\"echo run\";export APPSODY_DEBUG=\"echo debug \";echo $APPSODY_RUN;echo $APPSODY_DEBUG;export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;go run ../main.go  -v=true"}
+		args := []string{"unset APPSODY_WATCH_DIR;unset APPSODY_MOUNTS;export APPSODY_RUN=\"echo run\";export APPSODY_DEBUG=\"echo debug \";echo $APPSODY_RUN;echo $APPSODY_DEBUG;export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;go run ..  -v=true"}
 
 		output, err := RunBashCmdExec(args, ".")
 		log.Println(output)
@@ -84,7 +92,7 @@ func TestWatchAction(t *testing.T) {
 			The controller is invoked with verbose logging.
 			The output is checked for the correct watch interval, APPSODY_ON_CHANGE command and APPSODY_RUN command
 		*/
-		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"c:\\bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run ../main.go -v=true"}
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"c:\\bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run .. -v=true"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -102,6 +110,449 @@ func TestWatchAction(t *testing.T) {
 
 }
 
+// TestChangedFiles
+// The ON_CHANGE command is given the changed files in APPSODY_CHANGED_FILES and APPSODY_CHANGED_FILES_MANIFEST
+func TestChangedFiles(t *testing.T) {
+	log.Println("TestChangedFiles")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestChangedFiles", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_WATCH_REGEX - to match java files
+			APPSODY_WATCH_DIR
+			APPSODY_RUN_ON_CHANGE - echoes both variables and prints the manifest
+			APPSODY_RUN
+
+			The output is checked for the path of the touched java file and for its path and CREATE operation in the manifest,
+			which must be a file of its own in a directory of its own
+		*/
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";" +
+			"export APPSODY_RUN_ON_CHANGE='echo \"changed files: $APPSODY_CHANGED_FILES\"; echo \"manifest: $APPSODY_CHANGED_FILES_MANIFEST\"; cat \"$APPSODY_CHANGED_FILES_MANIFEST\"; echo; sleep 60';" +
+			"export APPSODY_RUN=\"sleep 60\";go run .."}
+
+		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if !strings.Contains(output, "changed files: "+projectDir+"/new.java\n") ||
+			!strings.Contains(output, "[{\"op\":\"CREATE\",\"path\":\""+projectDir+"/new.java\"}]") ||
+			!regexp.MustCompile(`manifest: /.*/appsody-controller-[^/]+/changed-files-[0-9]+\.json\n`).MatchString(output) {
+			t.Fail()
+		}
+	})
+}
+
+// TestWatchActionPoll
+// The polling file watcher detects the same changes as the inotify file watcher
+func TestWatchActionPoll(t *testing.T) {
+	log.Println("TestWatchActionPoll")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestWatchActionPoll", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_WATCH_BACKEND - forces the polling watcher
+			APPSODY_WATCH_REGEX - to match java files
+			APPSODY_WATCH_DIR
+			APPSODY_WATCH_INTERVAL
+			APPSODY_RUN_ON_CHANGE
+			APPSODY_RUN
+
+			The controller is invoked with verbose logging.
+			The output is checked for the polling watcher and a single APPSODY_ON_CHANGE command
+		*/
+		args := []string{"export APPSODY_WATCH_BACKEND=poll;export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";env |grep APPSODY;go run .. -v=true"}
+
+		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "Using the poll file watcher") && strings.Count(output, "Running command:  sleep 2") == 2 {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+// TestWatchDebounce
+// A burst of file changes runs the ON_CHANGE action once
+func TestWatchDebounce(t *testing.T) {
+	log.Println("TestWatchDebounce")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestWatchDebounce", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_WATCH_DEBOUNCE - one second quiet period
+			APPSODY_WATCH_REGEX - to match java and go files
+			APPSODY_WATCH_DIR
+			APPSODY_RUN_ON_CHANGE
+			APPSODY_RUN
+
+			The controller is invoked with verbose logging.
+			The output is checked for a single APPSODY_ON_CHANGE command for both the .go and .java files touched by the util
+		*/
+		args := []string{"export APPSODY_WATCH_DEBOUNCE=1000;export APPSODY_WATCH_REGEX=\"(^.*.java$)|(^.*.go$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";env |grep APPSODY;go run .. -v=true"}
+
+		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "about to perform the ON_CHANGE action for 2 file events") && strings.Count(output, "Running command:  sleep 2") == 2 {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestRestartOnFailure(t *testing.T) {
+	log.Println("TestRestartOnFailure")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestRestartOnFailure", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - exits with 3, the second run stays up for longer than the 30 second reset period first
+		APPSODY_RUN_RESTART - on-failure
+		APPSODY_RESTART_BACKOFF - 100 milliseconds
+		APPSODY_RESTART_MAX_RETRIES - 2
+		The backoff must double after each restart and go back to 100ms after the long run,
+		the fourth run is a crash loop and the controller exits with the exit code of the server
+		*/
+		args := []string{"export APPSODY_RUN='n=$(cat " + projectDir + "/runs 2>/dev/null || echo 0); n=$((n+1)); echo $n > " + projectDir + "/runs; " +
+			"echo \"server run $n\"; if [ $n -eq 2 ]; then sleep 31; fi; exit 3';" +
+			"export APPSODY_RUN_RESTART=on-failure;export APPSODY_RESTART_BACKOFF=100;export APPSODY_RESTART_MAX_RETRIES=2;go run .."}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+		if err == nil || !strings.Contains(output, "server run 4\n") || strings.Contains(output, "server run 5\n") ||
+			strings.Count(output, "restarting it in 100ms (restart policy on-failure)") != 2 ||
+			strings.Count(output, "restarting it in 200ms (restart policy on-failure)") != 1 ||
+			strings.Index(output, "restarting it in 200ms") < strings.LastIndex(output, "restarting it in 100ms") ||
+			!strings.Contains(output, "is crash looping, it exited 3 times in a row") {
+			t.Fail()
+		}
+	})
+}
+
+func TestRestartNever(t *testing.T) {
+	log.Println("TestRestartNever")
+
+	t.Run("TestRestartNever", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - exits with 3
+		APPSODY_RUN_RESTART - never
+		The server must not be restarted and the controller exits with the exit code of the server
+		*/
+		args := []string{"export APPSODY_RUN='echo server run; exit 3';export APPSODY_RUN_RESTART=never;go run .."}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+		if err == nil || strings.Count(output, "server run\n") != 1 || strings.Contains(output, "restarting it in") {
+			t.Fail()
+		}
+	})
+}
+
+func TestReadinessProbe(t *testing.T) {
+	log.Println("TestReadinessProbe")
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestReadinessProbe", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_READINESS_PROBE - a log probe for the line printed by the server
+			APPSODY_READINESS_PROBE_INTERVAL - probe every second
+			APPSODY_RUN - prints the line after two seconds and exits a few seconds later
+
+			The controller is invoked with verbose logging.
+			The output is checked for the server becoming ready
+		*/
+		args := []string{"export APPSODY_READINESS_PROBE=\"log:Server listening$\";export APPSODY_READINESS_PROBE_INTERVAL=1;export APPSODY_RUN=\"sleep 2;echo Server listening;sleep 4\";env |grep APPSODY;go run .. -v=true"}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "Starting the readiness log probe") && strings.Contains(output, "process with pid") && strings.Contains(output, "is ready.") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestStopEscalation(t *testing.T) {
+	log.Println("TestStopEscalation")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestStopEscalation", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_RUN_STOP_TIMEOUT - one second grace period after each signal
+			APPSODY_WATCH_DIR
+			APPSODY_RUN_ON_CHANGE
+			APPSODY_RUN - ignores SIGINT
+
+			The controller is invoked with verbose logging.
+			The output is checked for the server being stopped by SIGTERM when the ON_CHANGE action kills it
+		*/
+		args := []string{"export APPSODY_RUN_STOP_TIMEOUT=1;export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"trap '' INT;sleep 30\";env |grep APPSODY;go run .. -v=true"}
+
+		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "did not stop within 1s, sending SIGTERM") && strings.Contains(output, "was stopped by SIGTERM") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestBuildFailure(t *testing.T) {
+	log.Println("TestBuildFailure")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestBuildFailure", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_RUN_BUILD - a build which always fails
+			APPSODY_WATCH_DIR
+			APPSODY_RUN_ON_CHANGE
+			APPSODY_RUN
+
+			The controller is invoked with verbose logging.
+			The output is checked for the failed build, and that neither the server was killed nor the ON_CHANGE action run
+		*/
+		args := []string{"export APPSODY_RUN_BUILD=\"exit 1\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 120\";env |grep APPSODY;go run .. -v=true"}
+
+		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "The APPSODY_RUN/DEBUG/TEST_BUILD command failed with exit code 1") && !strings.Contains(output, "Running command:  sleep 2\n") && !strings.Contains(output, "was stopped by") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestConfigFile(t *testing.T) {
+	log.Println("TestConfigFile")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	configFile := filepath.Join(projectDir, "controller.yaml")
+	config := "prep: echo prep from the file\nrun:\n  command: echo run from the file\n"
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestConfigFile", func(t *testing.T) {
+		/*
+			The configuration file sets APPSODY_PREP and APPSODY_RUN
+			The Following environment variables are set:
+			APPSODY_PREP - overrides the configuration file
+
+			The controller is invoked with the configuration file.
+			The output is checked for the server command from the file and the prep command from the environment
+		*/
+		args := []string{"export APPSODY_PREP=\"echo prep from the environment\";go run .. --config=" + configFile}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "\nrun from the file") && strings.Contains(output, "\nprep from the environment") &&
+			strings.Contains(output, "overridden by the environment variables: APPSODY_PREP") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	log.Println("TestInvalidConfiguration")
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestInvalidConfiguration", func(t *testing.T) {
+		/*
+			The Following environment variables are set to invalid values:
+			APPSODY_WATCH_INTERVAL
+			APPSODY_WATCH_REGEX
+			APPSODY_WATCH_DIR - does not exist
+			The following environment variables are set
+			APPSODY_RUN_ON_CHANGE
+			APPSODY_RUN
+
+			The controller is invoked with verbose logging.
+			The output is checked for every problem and the controller must exit with the invalid configuration exit code
+		*/
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$\";export APPSODY_WATCH_DIR=/tmp/watchdir-missing;export APPSODY_WATCH_INTERVAL=abc;export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"echo run\";go run .. -v=true"}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if strings.Contains(output, "3 problem(s) found in the configuration") && strings.Contains(output, "APPSODY_WATCH_INTERVAL=\"abc\"") &&
+			strings.Contains(output, "APPSODY_WATCH_REGEX=") && strings.Contains(output, "The directory specified for file watching does not exist: /tmp/watchdir-missing") &&
+			strings.Contains(output, "exit status 78") && !strings.Contains(output, "Running command:") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestCheckConfig(t *testing.T) {
+	log.Println("TestCheckConfig")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestCheckConfig", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_MOUNTS
+			APPSODY_RUN_ON_CHANGE
+			APPSODY_RUN
+
+			The controller is invoked with --check and JSON output.
+			The output is checked for the effective configuration, and that nothing was started
+		*/
+		args := []string{"export APPSODY_MOUNTS=\".:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";go run .. --check --format=json"}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if err == nil && strings.Contains(output, "\"valid\": true") && strings.Contains(output, "\"startCommand\": \"sleep 10\"") &&
+			strings.Contains(output, "\"watchDirsSource\": \"APPSODY_MOUNTS\"") && strings.Contains(output, projectDir) &&
+			!strings.Contains(output, "Running command:") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestJSONLog(t *testing.T) {
+	log.Println("TestJSONLog")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestJSONLog", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_MOUNTS
+			APPSODY_RUN - exits straight away
+
+			The controller is invoked with --log-format=json and --no-watcher so that it exits with the server.
+			The output is checked for JSON log entries with the level, mode, process type and cycle
+		*/
+		args := []string{"export APPSODY_MOUNTS=\".:" + projectDir + "\";export APPSODY_RUN=\"echo hello\";go run .. --no-watcher --log-format=json"}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if err == nil && strings.Contains(output, "\"level\":\"info\",\"message\":\"Running command:  echo hello\",\"mode\":\"run\",\"processType\":\"server\",\"cycle\":1}") &&
+			strings.Contains(output, "hello\n") && !strings.Contains(output, "[Info]") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
+func TestOutputPrefix(t *testing.T) {
+	log.Println("TestOutputPrefix")
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	// call t.Run so that we can name and report on individual tests
+	t.Run("TestOutputPrefix", func(t *testing.T) {
+		/*
+			The Following environment variables are set:
+			APPSODY_MOUNTS
+			APPSODY_PREP
+			APPSODY_RUN - writes to stdout and stderr and exits straight away
+			APPSODY_OUTPUT_PREFIX
+
+			The controller is invoked with --no-watcher so that it exits with the server.
+			The output is checked for the role and restart cycle prefixes
+		*/
+		args := []string{"export APPSODY_MOUNTS=\".:" + projectDir + "\";export APPSODY_PREP=\"echo prep\";export APPSODY_RUN=\"echo hello; echo error >&2\";export APPSODY_OUTPUT_PREFIX=true;go run .. --no-watcher"}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+
+		log.Printf("error is:  %v\n", err)
+		if err == nil && strings.Contains(output, "[PREP #0] prep\n") && strings.Contains(output, "[RUN #1] hello\n") &&
+			strings.Contains(output, "[RUN #1] error\n") {
+			log.Println("pass")
+		} else {
+			t.Fail()
+		}
+
+	})
+
+}
+
 func TestBadPrep(t *testing.T) {
 	log.Println("TestBadPrep")
 
@@ -124,7 +575,7 @@ func TestBadPrep(t *testing.T) {
 		The controller is executed with verbose logging
 		The output is checked for an APPSODY_PREP error
 		*/
-		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\";export APPSODY_PREP=\"badbad\" ; export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run ../main.go -v=true"}
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\";export APPSODY_PREP=\"badbad\" ; export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run .. -v=true"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -165,7 +616,7 @@ func TestBadAPPSODYRun(t *testing.T) {
 		The controller is executed with verbose logging
 		The output is checked for a error for server start
 		*/
-		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\";export APPSODY_PREP=\"ls\" ; export APPSODY_RUN=\"bad\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run ../main.go -v=true"}
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\";export APPSODY_PREP=\"ls\" ; export APPSODY_RUN=\"bad\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run .. -v=true"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -206,7 +657,7 @@ func TestBadOnChange(t *testing.T) {
 		The controller is executed with verbose logging
 		The output is checked for a error for the wait for the on change command.
 		*/
-		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"bad\";export APPSODY_PREP=\"ls\" ; export APPSODY_RUN=\"ls\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run ../main.go -v=true"}
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"bad\";export APPSODY_PREP=\"ls\" ; export APPSODY_RUN=\"ls\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run .. -v=true"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -245,7 +696,7 @@ func TestBadWatchDir(t *testing.T) {
 		The controller is executed with verbose logging
 		The output is checked for a error because the watch directory does not exist.
 		*/
-		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=/tmp/watchdir4;export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\";export APPSODY_PREP=\"ls\" ; export APPSODY_RUN=\"ls\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run ../main.go -v=true"}
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=/tmp/watchdir4;export APPSODY_WATCH_INTERVAL=1;export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\";export APPSODY_PREP=\"ls\" ; export APPSODY_RUN=\"ls\";export APPSODY_DEBUG=\"echo debug \";env |grep APPSODY;go run .. -v=true"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -291,7 +742,7 @@ func TestWatchActionDebug(t *testing.T) {
 		The output is checked the appropriate debug and APPSODY_DEBUG_ON_CHANGE output
 		*/
 
-		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_DEBUG_ON_CHANGE=\"sleep 25\";export APPSODY_RUN_ON_CHANGE=\"sleep 25\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"sleep 10\";env |grep APPSODY;go run ../main.go -v=true -mode=debug"}
+		args := []string{"export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_DEBUG_ON_CHANGE=\"sleep 25\";export APPSODY_RUN_ON_CHANGE=\"sleep 25\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"sleep 10\";env |grep APPSODY;go run .. -v=true -mode=debug"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -338,7 +789,7 @@ func TestAA(t *testing.T) {
 		The output is checked the appropriate APPSODY_TEST output
 		*/
 
-		args := []string{"export APPSODY_TEST=\"ls -l;sleep 10\";export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"sleep 10\";env |grep APPSODY;go run ../main.go -v=true -mode=test"}
+		args := []string{"export APPSODY_TEST=\"ls -l;sleep 10\";export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_RUN_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"sleep 10\";env |grep APPSODY;go run .. -v=true -mode=test"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", false, projectDir)
 		log.Println("This is the output: " + output)
@@ -381,7 +832,7 @@ func TestTAAFail(t *testing.T) {
 		The controller is executed in debug mode with verbose logging
 		The output is checked the appropriate output for the bad test command given for APPSODY_TEST
 		*/
-		args := []string{"export APPSODY_TEST=\"bad 4\";export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_TEST_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"sleep 10\";env |grep APPSODY;go run ../main.go -v=true -mode=test"}
+		args := []string{"export APPSODY_TEST=\"bad 4\";export APPSODY_WATCH_REGEX=\"(^.*.java$)\";export APPSODY_WATCH_DIR=" + projectDir + ";export APPSODY_MOUNTS=\"/bad:" + projectDir + "\";export APPSODY_TEST_ON_CHANGE=\"sleep 2\" ;export APPSODY_RUN=\"sleep 10\";export APPSODY_DEBUG=\"sleep 10\";env |grep APPSODY;go run .. -v=true -mode=test"}
 
 		output, err := RunBashCmdExecAndKillAndTouch(args, ".", true, projectDir)
 		log.Println("This is the output: " + output)
@@ -398,3 +849,682 @@ func TestTAAFail(t *testing.T) {
 	})
 
 }
+
+// TestControlAPI
+// The control API reports status, restarts the server and shuts the controller down
+func TestControlAPI(t *testing.T) {
+	log.Println("TestControlAPI")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestControlAPI", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		The controller is executed with verbose logging
+		The status is checked before and after a restart, then the metrics are checked for the restart
+		and the controller is shut down through the API
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"sleep 60\";export APPSODY_CONTROL_SOCKET="+socketPath+";go run .. -v=true")
+		execCmd.Stdout = os.Stdout
+		execCmd.Stderr = os.Stderr
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var status struct {
+			Mode      string `json:"mode"`
+			ServerPid int    `json:"serverPid"`
+		}
+		output, err := ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		log.Println("Status: " + output)
+		if err != nil || json.Unmarshal([]byte(output), &status) != nil || status.Mode != "run" || status.ServerPid == 0 {
+			t.Fatalf("unexpected status %v %v", output, err)
+		}
+		firstPid := status.ServerPid
+
+		output, err = ControlAPIRequest(socketPath, http.MethodPost, "/restart")
+		log.Println("Restart: " + output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Second)
+		output, err = ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		log.Println("Status: " + output)
+		if err != nil || json.Unmarshal([]byte(output), &status) != nil || status.ServerPid == 0 || status.ServerPid == firstPid {
+			t.Fatalf("server was not restarted %v %v", output, err)
+		}
+
+		output, err = ControlAPIRequest(socketPath, http.MethodGet, "/metrics")
+		log.Println("Metrics: " + output)
+		if err != nil || !strings.Contains(output, "appsody_controller_server_restarts_total{reason=\"requested\"} 1\n") ||
+			!strings.Contains(output, "appsody_controller_kill_duration_seconds_count{process_type=\"server\"} 1\n") {
+			t.Fatalf("unexpected metrics %v %v", output, err)
+		}
+
+		output, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown")
+		log.Println("Shutdown: " + output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- execCmd.Wait()
+		}()
+		select {
+		case err = <-done:
+			log.Printf("controller exited with %v\n", err)
+		case <-time.After(30 * time.Second):
+			t.Fatal("the controller did not shut down")
+		}
+	})
+}
+
+func TestControlAPIEvents(t *testing.T) {
+	log.Println("TestControlAPIEvents")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestControlAPIEvents", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		The event stream is opened as Server-Sent Events and as newline delimited JSON, then the server is restarted
+		through the API. Both streams must report that the server was killed, that it exited and that it was started again, in that order.
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"sleep 60\";export APPSODY_CONTROL_SOCKET="+socketPath+";go run .. -v=true")
+		execCmd.Stdout = os.Stdout
+		execCmd.Stderr = os.Stderr
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		streams := map[string]<-chan string{}
+		for _, path := range []string{"/events", "/events?format=ndjson"} {
+			events, closeStream, err := ControlAPIEvents(socketPath, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeStream()
+			streams[path] = events
+		}
+
+		output, err := ControlAPIRequest(socketPath, http.MethodPost, "/restart")
+		log.Println("Restart: " + output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"processKilled server", "processExited server", "processStarted server"}
+		for path, events := range streams {
+			var received []string
+			timeout := time.After(30 * time.Second)
+		read:
+			for {
+				select {
+				case event, ok := <-events:
+					if !ok {
+						break read
+					}
+					received = append(received, event)
+					if strings.HasPrefix(event, "invalid") {
+						t.Errorf("%v: %v", path, event)
+					}
+					if event == "processStarted server" {
+						break read
+					}
+				case <-timeout:
+					break read
+				}
+			}
+			log.Printf("Events from %v: %v\n", path, received)
+			next := 0
+			for _, event := range received {
+				if next < len(expected) && event == expected[next] {
+					next++
+				}
+			}
+			if next != len(expected) {
+				t.Errorf("%v did not stream the events %v in order, received %v", path, expected, received)
+			}
+		}
+
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+	})
+}
+
+func TestReaper(t *testing.T) {
+	log.Println("TestReaper")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestReaper", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - starts background processes which are orphaned and exit while the server keeps running
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		The controller is executed with verbose logging
+		The controller is found as the parent of the server pid from the status, and is checked for zombie children
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"for i in 1 2 3; do (sleep 1 &); done; sleep 60\";export APPSODY_CONTROL_SOCKET="+socketPath+";go run .. -v=true")
+		execCmd.Stdout = os.Stdout
+		execCmd.Stderr = os.Stderr
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var status struct {
+			ServerPid int `json:"serverPid"`
+		}
+		output, err := ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		log.Println("Status: " + output)
+		if err != nil || json.Unmarshal([]byte(output), &status) != nil || status.ServerPid == 0 {
+			t.Fatalf("unexpected status %v %v", output, err)
+		}
+		controllerPid, err := ParentPid(status.ServerPid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the orphaned sleeps exit after a second
+		time.Sleep(3 * time.Second)
+		if zombies := ZombieChildren(controllerPid); len(zombies) > 0 {
+			t.Fatalf("the controller with pid %v has zombie children %v", controllerPid, zombies)
+		}
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+	})
+}
+
+func TestProcessTracking(t *testing.T) {
+	log.Println("TestProcessTracking")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestProcessTracking", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - starts a process in a new session, which leaves the process group of the server
+		APPSODY_PROCESS_TRACKING - proc
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		The controller is shut down through the control API
+		The output is checked for the process in the new session being killed as a leftover
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"setsid sleep 60 & sleep 60\";export APPSODY_PROCESS_TRACKING=proc;export APPSODY_CONTROL_SOCKET="+socketPath+";go run ..")
+		var output bytes.Buffer
+		execCmd.Stdout = &output
+		execCmd.Stderr = &output
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+		log.Println("This is the output: " + output.String())
+		if !strings.Contains(output.String(), "left 1 descendant process(es) running, they were killed with SIGKILL") {
+			t.Fail()
+		}
+	})
+}
+
+func TestForwardSignals(t *testing.T) {
+	log.Println("TestForwardSignals")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestForwardSignals", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - traps SIGHUP
+		APPSODY_FORWARD_SIGNALS - SIGHUP
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		The controller, found as the parent of the server pid from the status, is sent SIGHUP
+		The output is checked for the server receiving the signal and the controller still running
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"trap 'echo received SIGHUP' HUP; while true; do sleep 0.2; done\";export APPSODY_FORWARD_SIGNALS=SIGHUP;export APPSODY_CONTROL_SOCKET="+socketPath+";go run ..")
+		var output bytes.Buffer
+		execCmd.Stdout = &output
+		execCmd.Stderr = &output
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var status struct {
+			ServerPid int `json:"serverPid"`
+		}
+		statusOutput, err := ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		if err != nil || json.Unmarshal([]byte(statusOutput), &status) != nil || status.ServerPid == 0 {
+			t.Fatalf("unexpected status %v %v", statusOutput, err)
+		}
+		controllerPid, err := ParentPid(status.ServerPid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = syscall.Kill(controllerPid, syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+		// the controller is still running after the signal
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+		log.Println("This is the output: " + output.String())
+		if !strings.Contains(output.String(), "Forwarded SIGHUP to the APPSODY_RUN/DEBUG/TEST process group") || !strings.Contains(output.String(), "received SIGHUP") {
+			t.Fail()
+		}
+	})
+}
+
+func TestReloadSignal(t *testing.T) {
+	log.Println("TestReloadSignal")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestReloadSignal", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - traps SIGUSR2
+		APPSODY_RUN_ON_CHANGE - echo compiled
+		APPSODY_RUN_RELOAD_SIGNAL - SIGUSR2
+		APPSODY_WATCH_DIR - the temporary project directory
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		An ON_CHANGE action is requested through the control API
+		The output is checked for the ON_CHANGE command and the server receiving the signal, the server pid must not change
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"trap 'echo received SIGUSR2' USR2; while true; do sleep 0.2; done\";export APPSODY_RUN_ON_CHANGE=\"echo compiled\";export APPSODY_RUN_RELOAD_SIGNAL=SIGUSR2;export APPSODY_WATCH_DIR="+projectDir+";export APPSODY_CONTROL_SOCKET="+socketPath+";go run ..")
+		var output bytes.Buffer
+		execCmd.Stdout = &output
+		execCmd.Stderr = &output
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var status struct {
+			ServerPid int `json:"serverPid"`
+		}
+		statusOutput, err := ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		if err != nil || json.Unmarshal([]byte(statusOutput), &status) != nil || status.ServerPid == 0 {
+			t.Fatalf("unexpected status %v %v", statusOutput, err)
+		}
+		serverPid := status.ServerPid
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/onchange"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Second)
+		statusOutput, err = ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		if err != nil || json.Unmarshal([]byte(statusOutput), &status) != nil {
+			t.Fatalf("unexpected status %v %v", statusOutput, err)
+		}
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+		log.Println("This is the output: " + output.String())
+		if status.ServerPid != serverPid {
+			t.Errorf("the server was restarted, pid %v is now %v", serverPid, status.ServerPid)
+		}
+		if !strings.Contains(output.String(), "compiled") || !strings.Contains(output.String(), "Sent SIGUSR2 to the APPSODY_RUN/DEBUG/TEST process group") || !strings.Contains(output.String(), "received SIGUSR2") {
+			t.Fail()
+		}
+	})
+}
+
+func TestExitOnServerExit(t *testing.T) {
+	log.Println("TestExitOnServerExit")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestExitOnServerExit", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - exits with 4
+		APPSODY_RUN_ON_CHANGE - so that the file watcher runs
+		APPSODY_RUN_EXIT_ON_SERVER_EXIT - true
+		APPSODY_WATCH_DIR - the temporary project directory
+		The controller must exit with the exit code of the server although the file watcher is running
+		*/
+		args := []string{"export APPSODY_RUN=\"sleep 1; exit 4\";export APPSODY_RUN_ON_CHANGE=\"echo change\";export APPSODY_RUN_EXIT_ON_SERVER_EXIT=true;export APPSODY_WATCH_DIR=" + projectDir + ";go run .."}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+		if err == nil || !strings.Contains(output, "exit status 4") || !strings.Contains(output, "the controller is exiting because APPSODY_RUN_EXIT_ON_SERVER_EXIT is true") {
+			t.Fail()
+		}
+	})
+}
+
+func TestPrepWatch(t *testing.T) {
+	log.Println("TestPrepWatch")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestPrepWatch", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_PREP - echo prep ran
+		APPSODY_PREP_WATCH_REGEX - package.json
+		APPSODY_RUN - a long running server
+		APPSODY_WATCH_DIR - the temporary project directory
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		package.json is written to the project directory
+		The output is checked for APPSODY_PREP running again and the server must have been restarted
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_PREP=\"echo prep ran\";export APPSODY_PREP_WATCH_REGEX=\"^package\\.json$\";export APPSODY_RUN=\"while true; do sleep 0.2; done\";export APPSODY_WATCH_DIR="+projectDir+";export APPSODY_CONTROL_SOCKET="+socketPath+";go run ..")
+		var output bytes.Buffer
+		execCmd.Stdout = &output
+		execCmd.Stderr = &output
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var status struct {
+			ServerPid int `json:"serverPid"`
+		}
+		statusOutput, err := ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		if err != nil || json.Unmarshal([]byte(statusOutput), &status) != nil || status.ServerPid == 0 {
+			t.Fatalf("unexpected status %v %v", statusOutput, err)
+		}
+		serverPid := status.ServerPid
+		if err = ioutil.WriteFile(filepath.Join(projectDir, "package.json"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(4 * time.Second)
+		statusOutput, err = ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		if err != nil || json.Unmarshal([]byte(statusOutput), &status) != nil {
+			t.Fatalf("unexpected status %v %v", statusOutput, err)
+		}
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+		log.Println("This is the output: " + output.String())
+		if status.ServerPid == 0 || status.ServerPid == serverPid {
+			t.Errorf("the server was not restarted, pid %v is now %v", serverPid, status.ServerPid)
+		}
+		if strings.Count(output.String(), "\nprep ran\n") != 2 || !strings.Contains(output.String(), "package.json changed, stopping the APPSODY_RUN/DEBUG/TEST process to run APPSODY_PREP again") ||
+			!strings.Contains(output.String(), "The APPSODY_PREP command succeeded") {
+			t.Fail()
+		}
+	})
+}
+
+func TestPrepCache(t *testing.T) {
+	log.Println("TestPrepCache")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	if err = ioutil.WriteFile(filepath.Join(projectDir, "package.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("TestPrepCache", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_PREP - echo prep ran
+		APPSODY_PREP_CACHE_INPUTS - package.json in the temporary project directory
+		APPSODY_PREP_CACHE_DIR - a cache directory in the temporary project directory
+		APPSODY_RUN - echo run
+		The controller runs three times, APPSODY_PREP must be skipped the second time and run again with --force-prep
+		*/
+		env := "export APPSODY_PREP=\"echo prep ran\";export APPSODY_PREP_CACHE_INPUTS=" + filepath.Join(projectDir, "package.json") +
+			";export APPSODY_PREP_CACHE_DIR=" + filepath.Join(projectDir, "cache") + ";export APPSODY_RUN=\"echo run\";"
+		var outputs []string
+		for _, flags := range []string{"", "", " --force-prep"} {
+			output, err := RunBashCmdExec([]string{env + "go run .." + flags}, ".")
+			log.Println("This is the output: " + output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, output)
+		}
+		if !strings.Contains(outputs[0], "\nprep ran\n") || !strings.Contains(outputs[1], "Skipping APPSODY_PREP") ||
+			strings.Contains(outputs[1], "\nprep ran\n") || !strings.Contains(outputs[2], "\nprep ran\n") {
+			t.Fail()
+		}
+	})
+}
+
+func TestPrepSteps(t *testing.T) {
+	log.Println("TestPrepSteps")
+
+	t.Run("TestPrepSteps", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_PREP - a list of three steps, the second step fails
+		APPSODY_RUN - echo run
+		The controller must exit naming the failed step, without running the third step or the server
+		*/
+		env := "export APPSODY_PREP='[{\"name\":\"install\",\"command\":\"echo install ran\"},{\"name\":\"generate\",\"command\":\"exit 3\",\"retries\":1}," +
+			"{\"name\":\"verify\",\"command\":\"echo verify ran\"}]';export APPSODY_RUN=\"echo run\";"
+		output, err := RunBashCmdExec([]string{env + "go run .."}, ".")
+		log.Println("This is the output: " + output)
+		if err == nil || !strings.Contains(output, "\ninstall ran\n") || strings.Contains(output, "\nverify ran\n") ||
+			!strings.Contains(output, "step \"generate\" failed after 2 attempt(s)") || !strings.Contains(output, "verify not run") ||
+			strings.Contains(output, "\nrun\n") {
+			t.Fail()
+		}
+	})
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	log.Println("TestLifecycleHooks")
+
+	t.Run("TestLifecycleHooks", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - exits with 5
+		APPSODY_RUN_POST_START - echo the pid of the server
+		APPSODY_RUN_ON_FAILURE - echo the exit code of the server
+		The post-start hook must run after the server starts and the on-failure hook once it fails, both with a hook prefix
+		*/
+		args := []string{"export APPSODY_RUN=\"sleep 1; exit 5\";export APPSODY_RUN_POST_START='echo started $APPSODY_SERVER_PID';" +
+			"export APPSODY_RUN_ON_FAILURE='echo failed with $APPSODY_EXIT_CODE';go run .."}
+
+		output, err := RunBashCmdExec(args, ".")
+		log.Println("This is the output: " + output)
+		if err == nil || !strings.Contains(output, "[POST_START hook #1] started ") || !strings.Contains(output, "[ON_FAILURE hook #1] failed with 5") ||
+			!strings.Contains(output, "The APPSODY_RUN_ON_FAILURE hook finished in") {
+			t.Fail()
+		}
+	})
+}
+
+func TestOnChangePolicy(t *testing.T) {
+	log.Println("TestOnChangePolicy")
+
+	projectDir, err := ioutil.TempDir("", "watchdir2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(projectDir)
+	t.Run("TestOnChangePolicy", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - sleeps
+		APPSODY_RUN_ON_CHANGE - a compile which takes a second
+		APPSODY_RUN_KILL - false
+		APPSODY_ON_CHANGE_POLICY - queue-one
+		APPSODY_WATCH_DIR - the temporary project directory
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		Three ON_CHANGE actions are requested through the control API while the first one runs
+		The first compile must finish and the compile must run once more for the other two requests
+		*/
+		socketPath := filepath.Join(projectDir, "controller.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"sleep 60\";export APPSODY_RUN_ON_CHANGE=\"echo compile start; sleep 1; echo compile done\";"+
+			"export APPSODY_RUN_KILL=false;export APPSODY_ON_CHANGE_POLICY=queue-one;export APPSODY_WATCH_DIR="+projectDir+";export APPSODY_CONTROL_SOCKET="+socketPath+";go run ..")
+		var output bytes.Buffer
+		execCmd.Stdout = &output
+		execCmd.Stderr = &output
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/onchange"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		time.Sleep(3 * time.Second)
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+		log.Println("This is the output: " + output.String())
+		if strings.Count(output.String(), "\ncompile start\n") != 2 || strings.Count(output.String(), "\ncompile done\n") != 2 ||
+			!strings.Contains(output.String(), "Running the queued ON_CHANGE action") {
+			t.Fail()
+		}
+	})
+	t.Run("TestOnChangePolicyReloadFallback", func(t *testing.T) {
+		/* The following environment variables are set:
+		APPSODY_RUN - traps SIGUSR2
+		APPSODY_RUN_ON_CHANGE - echo compiled
+		APPSODY_RUN_RELOAD_SIGNAL - SIGUSR2
+		APPSODY_RUN_RESTART - never
+		APPSODY_ON_CHANGE_POLICY - queue-one
+		APPSODY_WATCH_DIR - the temporary project directory
+		APPSODY_CONTROL_SOCKET - a socket in the temporary project directory
+		The server is killed and an ON_CHANGE action is requested through the control API, the server is restarted in place of reloading it
+		A second ON_CHANGE action must then still run and reload the restarted server
+		*/
+		socketPath := filepath.Join(projectDir, "fallback.sock")
+		execCmd := exec.Command("/bin/sh", "-c", "export APPSODY_RUN=\"trap 'echo received SIGUSR2' USR2; while true; do sleep 0.2; done\";export APPSODY_RUN_ON_CHANGE=\"echo compiled\";export APPSODY_RUN_RELOAD_SIGNAL=SIGUSR2;"+
+			"export APPSODY_RUN_RESTART=never;export APPSODY_ON_CHANGE_POLICY=queue-one;export APPSODY_WATCH_DIR="+projectDir+";export APPSODY_CONTROL_SOCKET="+socketPath+";go run ..")
+		var output bytes.Buffer
+		execCmd.Stdout = &output
+		execCmd.Stderr = &output
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := execCmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+		}()
+
+		if err = WaitForFile(socketPath, 60*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		var status struct {
+			ServerPid int `json:"serverPid"`
+		}
+		statusOutput, err := ControlAPIRequest(socketPath, http.MethodGet, "/status")
+		if err != nil || json.Unmarshal([]byte(statusOutput), &status) != nil || status.ServerPid == 0 {
+			t.Fatalf("unexpected status %v %v", statusOutput, err)
+		}
+		if err = syscall.Kill(status.ServerPid, syscall.SIGKILL); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1 * time.Second)
+		for i := 0; i < 2; i++ {
+			if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/onchange"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Second)
+		}
+		if _, err = ControlAPIRequest(socketPath, http.MethodPost, "/shutdown"); err != nil {
+			t.Fatal(err)
+		}
+		_ = execCmd.Wait()
+		log.Println("This is the output: " + output.String())
+		if !strings.Contains(output.String(), "falling back to a full restart") || strings.Count(output.String(), "\ncompiled\n") != 2 ||
+			!strings.Contains(output.String(), "Sent SIGUSR2 to the APPSODY_RUN/DEBUG/TEST process group") || !strings.Contains(output.String(), "received SIGUSR2") {
+			t.Fail()
+		}
+	})
+}
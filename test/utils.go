@@ -17,10 +17,17 @@ package test
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -230,3 +237,124 @@ func RunBashCmdExecAndKillAndTouch(args []string, workingDir string, kill bool,
 
 	return outBuffer.String(), err
 }
+
+// ControlAPIRequest sends a request to the controller control API listening on the given Unix socket
+// The response body is returned
+func ControlAPIRequest(socketPath string, method string, path string) (string, error) {
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	req, err := http.NewRequest(method, "http://controller"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// ControlAPIEvents opens the event stream of the control API at the given path, such as /events or /events?format=ndjson.
+// Each event is sent to the returned channel as "<type> <processType>" until the stream is closed with the returned function.
+// The Server-Sent Events name of an event must match its type.
+func ControlAPIEvents(socketPath string, path string) (<-chan string, func(), error) {
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	resp, err := client.Get("http://controller" + path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("the event stream returned %v", resp.Status)
+	}
+	events := make(chan string, 100)
+	go func() {
+		defer close(events)
+		var name string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				name = strings.TrimPrefix(line, "event: ")
+				continue
+			}
+			data := strings.TrimPrefix(line, "data: ")
+			if data == "" {
+				continue
+			}
+			var event struct {
+				Type        string `json:"type"`
+				ProcessType string `json:"processType"`
+			}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				events <- "invalid " + line
+				continue
+			}
+			if data != line && name != event.Type {
+				events <- "invalid event name " + name + " for " + event.Type
+			}
+			name = ""
+			events <- event.Type + " " + event.ProcessType
+		}
+	}()
+	return events, func() { resp.Body.Close() }, nil
+}
+
+// WaitForFile waits up to timeout for the given file to exist
+func WaitForFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(path)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// ParentPid returns the parent pid of a process from /proc/<pid>/stat
+func ParentPid(pid int) (int, error) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	return strconv.Atoi(fields[1])
+}
+
+// ZombieChildren returns the pids of the children of a process which have exited and not been reaped
+func ZombieChildren(pid int) []int {
+	var zombies []int
+	entries, _ := ioutil.ReadDir("/proc")
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+		if len(fields) > 1 && fields[0] == "Z" && fields[1] == strconv.Itoa(pid) {
+			zombies = append(zombies, child)
+		}
+	}
+	return zombies
+}
@@ -0,0 +1,161 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// exitCodeInvalidConfig is the exit code when the configuration is invalid, EX_CONFIG from sysexits.h
+const exitCodeInvalidConfig = 78
+
+// configError is a problem with the value of one environment variable
+type configError struct {
+	environmentVar string
+	value          string
+	message        string
+}
+
+func (e configError) Error() string {
+	return fmt.Sprintf("%v=%q: %v", e.environmentVar, e.value, e.message)
+}
+
+// configErrors collects every problem found in the configuration so that they can be reported at once
+type configErrors []error
+
+func (e configErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = "  - " + err.Error()
+	}
+	return fmt.Sprintf("%v problem(s) found in the configuration:\n%v", len(e), strings.Join(messages, "\n"))
+}
+
+func (e *configErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// computeWholeNumber parses an environment variable which must be a whole number of at least min,
+// unit describes the number in the error message, for instance "seconds"
+func computeWholeNumber(envVar string, value string, defaultValue int, min int, unit string) (int, error) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(trimmed)
+	if err != nil || number < min {
+		return defaultValue, configError{envVar, value, fmt.Sprintf("Must be a whole number of %v of at least %v", unit, min)}
+	}
+	return number, nil
+}
+
+// computeBoolean parses an environment variable which must be true or false
+func computeBoolean(envVar string, value string, defaultValue bool) (bool, error) {
+	switch strings.TrimSpace(strings.ToUpper(value)) {
+	case "":
+		return defaultValue, nil
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	return defaultValue, configError{envVar, value, "Must be true or false"}
+}
+
+// validateRegex checks that the regular expression compiles
+func validateRegex(envVar string, value string, expr string) error {
+	if _, err := regexp.Compile(expr); err != nil {
+		return configError{envVar, value, "Invalid regular expression: " + err.Error()}
+	}
+	return nil
+}
+
+// validateWatchDirs checks that the directories watched in the controller mode exist
+func validateWatchDirs(envVar string, value string, dirs []string) configErrors {
+	var problems configErrors
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			problems.add(configError{envVar, value, "The directory specified for file watching does not exist: " + dir})
+		} else if !info.IsDir() {
+			problems.add(configError{envVar, value, "The path specified for file watching is not a directory: " + dir})
+		}
+	}
+	return problems
+}
+
+// validateBuild checks that a build command has an ON_CHANGE action or reload to gate
+func validateBuild(mode string, build string, onChange string, reload syscall.Signal) error {
+	if build != "" && onChange == "" && reload == 0 {
+		return configError{"APPSODY_" + mode + "_BUILD", build, "A build command requires APPSODY_" + mode + "_ON_CHANGE or APPSODY_" + mode + "_RELOAD_SIGNAL to be set"}
+	}
+	return nil
+}
+
+// modeWatchAction returns the ON_CHANGE action for the controller mode
+func modeWatchAction(mode string) string {
+	switch mode {
+	case "debug":
+		return appsodyDEBUGWATCHACTION
+	case "test":
+		return appsodyTESTWATCHACTION
+	}
+	return appsodyRUNWATCHACTION
+}
+
+// modeReloadSignal returns the reload signal for the controller mode, 0 if the server is restarted on change
+func modeReloadSignal(mode string) syscall.Signal {
+	switch mode {
+	case "debug":
+		return appsodyDEBUGRELOADSIGNAL
+	case "test":
+		return appsodyTESTRELOADSIGNAL
+	}
+	return appsodyRUNRELOADSIGNAL
+}
+
+// modeHooks returns the lifecycle hooks of the controller mode
+func modeHooks(mode string) lifecycleHooks {
+	switch mode {
+	case "debug":
+		return appsodyDEBUGHOOKS
+	case "test":
+		return appsodyTESTHOOKS
+	}
+	return appsodyRUNHOOKS
+}
+
+// combineConfigErrors returns the problems of all of the errors as one configErrors, or nil if there are none
+func combineConfigErrors(errs ...error) error {
+	var problems configErrors
+	for _, err := range errs {
+		if more, ok := err.(configErrors); ok {
+			problems = append(problems, more...)
+		} else {
+			problems.add(err)
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/appsody/watcher"
+)
+
+// Values for APPSODY_WATCH_BACKEND
+const (
+	watchBackendAuto    = "auto"
+	watchBackendInotify = "inotify"
+	watchBackendPoll    = "poll"
+)
+
+// errWatchFallback is returned by the inotify watcher when it can no longer deliver events,
+// for instance when the inotify watch limit is reached, and the polling watcher must be used instead.
+var errWatchFallback = errors.New("the inotify watcher can not watch all of the directories")
+
+// watchBackend is implemented by the polling watcher and the inotify watcher.
+// Events are only sent for files that pass every filter hook.
+type watchBackend interface {
+	AddFilterHook(f watcher.FilterFileHookFunc)
+	AddRecursive(name string) error
+	SetMaxEvents(delta int)
+	Start(d time.Duration) error
+	Close()
+	Events() <-chan watcher.Event
+	Errors() <-chan error
+	Closed() <-chan struct{}
+}
+
+// pollingWatcher adapts the appsody/watcher polling watcher, which rescans the directories every interval
+type pollingWatcher struct {
+	*watcher.Watcher
+}
+
+func (w pollingWatcher) Events() <-chan watcher.Event {
+	return w.Event
+}
+
+func (w pollingWatcher) Errors() <-chan error {
+	return w.Error
+}
+
+func (w pollingWatcher) Closed() <-chan struct{} {
+	return w.Watcher.Closed
+}
+
+// newWatchBackend creates the watcher for the backend, directories matching ignoredDirs are not watched by inotify
+func newWatchBackend(backend string, ignoredDirs []*regexp.Regexp) (watchBackend, error) {
+	if backend == watchBackendPoll {
+		return pollingWatcher{watcher.New()}, nil
+	}
+	return newInotifyWatcher(ignoredDirs)
+}
+
+// selectWatchBackend resolves the APPSODY_WATCH_BACKEND setting for the directories to watch.
+// In auto mode polling is used if any directory is on a filesystem that does not deliver inotify events.
+func selectWatchBackend(backend string, dirs []string) string {
+	if backend != watchBackendAuto {
+		return backend
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if fsType, unsupported := inotifyUnsupportedFilesystem(dir); unsupported {
+			ControllerInfo.log("The directory ", dir, " is on a filesystem that does not deliver inotify events (type ", fsType, "), file watching will use polling.")
+			return watchBackendPoll
+		}
+	}
+	return watchBackendInotify
+}
@@ -0,0 +1,474 @@
+package main
+
+// Copyright © 2019 IBM Corporation and others.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/appsody/watcher"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW | syscall.IN_ONLYDIR
+
+// inotify events read within this time of each other are coalesced before they are sent,
+// so that a single save which creates, writes and chmods a file results in one event
+const inotifySettleTime = 100 * time.Millisecond
+
+// Filesystem types which do not deliver inotify events for changes made outside of the container,
+// the Docker Desktop file sharing implementations use fuse, 9p or network filesystems for bind mounts.
+var inotifyUnsupportedFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+}
+
+// inotifyWatcher is an event driven replacement for the polling watcher
+type inotifyWatcher struct {
+	event       chan watcher.Event
+	errors      chan error
+	closed      chan struct{}
+	close       chan struct{}
+	closeOnce   sync.Once
+	fd          int
+	file        *os.File
+	ignoredDirs []*regexp.Regexp
+
+	// mu protects the following.
+	mu        sync.Mutex
+	ffh       []watcher.FilterFileHookFunc
+	watches   map[int]string // watch descriptor to directory
+	maxEvents int
+	running   bool
+}
+
+// inotifyFileInfo describes a file which no longer exists, so that removed files can be filtered and reported
+type inotifyFileInfo struct {
+	name  string
+	isDir bool
+}
+
+func (fi inotifyFileInfo) Name() string       { return fi.name }
+func (fi inotifyFileInfo) Size() int64        { return 0 }
+func (fi inotifyFileInfo) Mode() os.FileMode  { return 0 }
+func (fi inotifyFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi inotifyFileInfo) IsDir() bool        { return fi.isDir }
+func (fi inotifyFileInfo) Sys() interface{}   { return nil }
+
+func newInotifyWatcher(ignoredDirs []*regexp.Regexp) (watchBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize inotify: %v", err)
+	}
+	return &inotifyWatcher{
+		event:       make(chan watcher.Event),
+		errors:      make(chan error),
+		closed:      make(chan struct{}),
+		close:       make(chan struct{}),
+		fd:          fd,
+		file:        os.NewFile(uintptr(fd), "inotify"),
+		ignoredDirs: ignoredDirs,
+		watches:     make(map[int]string),
+	}, nil
+}
+
+// inotifyUnsupportedFilesystem returns the filesystem type of dir and whether it is known not to deliver inotify events
+func inotifyUnsupportedFilesystem(dir string) (string, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return "", false
+	}
+	fsType, found := inotifyUnsupportedFilesystems[int64(stat.Type)]
+	return fsType, found
+}
+
+func (w *inotifyWatcher) Events() <-chan watcher.Event {
+	return w.event
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotifyWatcher) Closed() <-chan struct{} {
+	return w.closed
+}
+
+func (w *inotifyWatcher) AddFilterHook(f watcher.FilterFileHookFunc) {
+	w.mu.Lock()
+	w.ffh = append(w.ffh, f)
+	w.mu.Unlock()
+}
+
+func (w *inotifyWatcher) SetMaxEvents(delta int) {
+	w.mu.Lock()
+	w.maxEvents = delta
+	w.mu.Unlock()
+}
+
+// AddRecursive adds an inotify watch for the directory and every directory below it
+func (w *inotifyWatcher) AddRecursive(name string) error {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	return w.addWatches(name, nil)
+}
+
+// addWatches walks the directory adding watches, if created is not nil it is called for every file found
+// as these files may have been created before the watch on their directory existed
+func (w *inotifyWatcher) addWatches(name string, created func(path string, info os.FileInfo)) error {
+	return filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the directory may have been removed while walking it
+			if os.IsNotExist(err) && path != name {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			if created != nil {
+				created(path, info)
+			}
+			return nil
+		}
+		if w.isIgnoredDir(path) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if err == syscall.ENOSPC {
+				// the limit set by /proc/sys/fs/inotify/max_user_watches has been reached
+				return errWatchFallback
+			}
+			return fmt.Errorf("could not watch %v: %v", path, err)
+		}
+		w.mu.Lock()
+		w.watches[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) isIgnoredDir(path string) bool {
+	for _, r := range w.ignoredDirs {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeWatches removes the watches for the directory and every directory below it
+func (w *inotifyWatcher) removeWatches(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for wd, path := range w.watches {
+		if path == name || strings.HasPrefix(path, name+string(filepath.Separator)) {
+			// the watch may already have been removed by the kernel
+			_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) filtered(info os.FileInfo, path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, f := range w.ffh {
+		if f(info, path) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Start reads inotify events until Close is called, the duration is not used as events are not polled
+func (w *inotifyWatcher) Start(d time.Duration) error {
+	w.mu.Lock()
+	if w.running {
+		w.mu.Unlock()
+		return watcher.ErrWatcherRunning
+	}
+	w.running = true
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	raw := make(chan []inotifyEvent)
+	readErr := make(chan error, 1)
+	defer close(done)
+
+	go func() {
+		buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*64)
+		for {
+			n, err := w.file.Read(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case raw <- parseInotifyEvents(buf[:n]):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stop := func(err error) error {
+		_ = w.file.Close()
+		close(w.closed)
+		return err
+	}
+
+	batch := newInotifyBatch()
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-w.close:
+			return stop(nil)
+		case events := <-raw:
+			for _, event := range events {
+				if err := w.handleEvent(event, batch); err != nil {
+					return stop(err)
+				}
+			}
+			settle = time.After(inotifySettleTime)
+		case <-settle:
+			settle = nil
+			if !w.sendEvents(batch.flush()) {
+				return stop(nil)
+			}
+		case err := <-readErr:
+			return stop(err)
+		}
+	}
+}
+
+// inotifyEvent is an inotify event with the name of the file, relative to the watched directory
+type inotifyEvent struct {
+	syscall.InotifyEvent
+	name string
+}
+
+func parseInotifyEvents(buf []byte) []inotifyEvent {
+	var events []inotifyEvent
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := *(*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+		events = append(events, inotifyEvent{event, name})
+		offset = nameStart + int(event.Len)
+	}
+	return events
+}
+
+// handleEvent translates an inotify event into watcher events in the batch, watching any new directories
+func (w *inotifyWatcher) handleEvent(event inotifyEvent, batch *inotifyBatch) error {
+	name := event.name
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		// events have been lost, report a change of the watched directories so that the ON_CHANGE action still runs
+		w.sendError(errors.New("the inotify event queue overflowed, some file events were lost"))
+		w.mu.Lock()
+		for _, dir := range w.watches {
+			if info, err := os.Stat(dir); err == nil {
+				batch.overflow = &watcher.Event{Op: watcher.Write, Path: dir, OldPath: dir, FileInfo: info}
+				break
+			}
+		}
+		w.mu.Unlock()
+		return nil
+	}
+	w.mu.Lock()
+	dir, found := w.watches[int(event.Wd)]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, int(event.Wd))
+	}
+	w.mu.Unlock()
+	if !found || name == "" {
+		return nil
+	}
+	path := filepath.Join(dir, name)
+	isDir := event.Mask&syscall.IN_ISDIR != 0
+
+	switch {
+	case event.Mask&syscall.IN_MOVED_FROM != 0:
+		if isDir {
+			w.removeWatches(path)
+		}
+		info := inotifyFileInfo{name: name, isDir: isDir}
+		batch.movedFrom(event.Cookie, watcher.Event{Op: watcher.Remove, Path: path, OldPath: path, FileInfo: info}, w.filtered(info, path))
+	case event.Mask&syscall.IN_DELETE != 0:
+		w.addEvent(batch, watcher.Event{Op: watcher.Remove, Path: path, OldPath: path, FileInfo: inotifyFileInfo{name: name, isDir: isDir}})
+	case event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		info, err := os.Lstat(path)
+		if err != nil {
+			// the file is already gone again
+			return nil
+		}
+		op := watcher.Create
+		oldPath := ""
+		if event.Mask&syscall.IN_MOVED_TO != 0 {
+			if from, ok := batch.movedTo(event.Cookie); ok {
+				oldPath = from
+				op = watcher.Move
+				if filepath.Dir(from) == filepath.Dir(path) {
+					op = watcher.Rename
+				}
+			}
+		}
+		w.addEvent(batch, watcher.Event{Op: op, Path: path, OldPath: oldPath, FileInfo: info})
+		if isDir {
+			// files created in the new directory before it was watched are reported as created
+			err = w.addWatches(path, func(filePath string, fileInfo os.FileInfo) {
+				w.addEvent(batch, watcher.Event{Op: watcher.Create, Path: filePath, FileInfo: fileInfo})
+			})
+			if err == errWatchFallback {
+				return err
+			}
+			if err != nil {
+				w.sendError(err)
+			}
+		}
+	case event.Mask&syscall.IN_CLOSE_WRITE != 0:
+		if info, err := os.Lstat(path); err == nil {
+			w.addEvent(batch, watcher.Event{Op: watcher.Write, Path: path, OldPath: path, FileInfo: info})
+		}
+	case event.Mask&syscall.IN_ATTRIB != 0:
+		if info, err := os.Lstat(path); err == nil {
+			w.addEvent(batch, watcher.Event{Op: watcher.Chmod, Path: path, OldPath: path, FileInfo: info})
+		}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) addEvent(batch *inotifyBatch, event watcher.Event) {
+	if w.filtered(event.FileInfo, event.Path) {
+		return
+	}
+	batch.add(event)
+}
+
+// sendEvents sends the coalesced events, it returns false if the watcher was closed while sending
+func (w *inotifyWatcher) sendEvents(events []watcher.Event) bool {
+	w.mu.Lock()
+	maxEvents := w.maxEvents
+	w.mu.Unlock()
+	for i, event := range events {
+		if maxEvents > 0 && i >= maxEvents {
+			break
+		}
+		select {
+		case w.event <- event:
+		case <-w.close:
+			return false
+		}
+	}
+	return true
+}
+
+func (w *inotifyWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	case <-w.close:
+	}
+}
+
+// Close stops the watcher, Start returns once it has released the inotify file descriptor
+func (w *inotifyWatcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.close)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if !w.running {
+			_ = w.file.Close()
+		}
+	})
+}
+
+// inotifyBatch coalesces the events for each path that arrive within the settle time
+type inotifyBatch struct {
+	events   []watcher.Event
+	index    map[string]int
+	moves    map[uint32]inotifyMove
+	overflow *watcher.Event
+}
+
+// inotifyMove is the first half of a rename or move, it is reported as a remove if the file was moved out of the watched directories
+type inotifyMove struct {
+	remove   watcher.Event
+	filtered bool
+}
+
+func newInotifyBatch() *inotifyBatch {
+	return &inotifyBatch{
+		index: make(map[string]int),
+		moves: make(map[uint32]inotifyMove),
+	}
+}
+
+// add keeps the first event for a path, so create followed by write is reported as a create,
+// except that a remove replaces any earlier event
+func (b *inotifyBatch) add(event watcher.Event) {
+	if i, found := b.index[event.Path]; found {
+		if event.Op == watcher.Remove {
+			b.events[i] = event
+		}
+		return
+	}
+	b.index[event.Path] = len(b.events)
+	b.events = append(b.events, event)
+}
+
+func (b *inotifyBatch) movedFrom(cookie uint32, remove watcher.Event, filtered bool) {
+	b.moves[cookie] = inotifyMove{remove, filtered}
+}
+
+func (b *inotifyBatch) movedTo(cookie uint32) (string, bool) {
+	move, found := b.moves[cookie]
+	if found {
+		delete(b.moves, cookie)
+	}
+	return move.remove.Path, found
+}
+
+// flush returns the coalesced events, a move out of the watched directories is reported as a remove
+func (b *inotifyBatch) flush() []watcher.Event {
+	events := b.events
+	if b.overflow != nil {
+		events = append([]watcher.Event{*b.overflow}, events...)
+	}
+	for _, move := range b.moves {
+		if !move.filtered {
+			events = append(events, move.remove)
+		}
+	}
+	b.events = nil
+	b.index = make(map[string]int)
+	b.moves = make(map[uint32]inotifyMove)
+	b.overflow = nil
+	return events
+}